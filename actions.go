@@ -1,22 +1,44 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var DEBUG bool = false
 
 // Mongodb supported actions.
 // To check against user requests.
-var supportedActions = []string{"find", "insert", "remove", "count", "update"}
-var supportedSubActions = []string{"sort", "limit", ""}
+var supportedActions = []string{"find", "findOne", "insert", "remove", "count", "update", "distinct", "aggregate",
+	"findAndModify", "findOneAndUpdate", "findOneAndDelete"}
+
+// Http methods allowed for each action.
+var actionMethods = map[string][]string{
+	"find":             {"GET"},
+	"findOne":          {"GET"},
+	"count":            {"GET"},
+	"distinct":         {"GET"},
+	"aggregate":        {"GET", "POST"},
+	"insert":           {"POST"},
+	"remove":           {"DELETE"},
+	"update":           {"PUT"},
+	"findAndModify":    {"PUT", "DELETE"},
+	"findOneAndUpdate": {"PUT"},
+	"findOneAndDelete": {"DELETE"},
+}
+var supportedSubActions = []string{"sort", "limit", "skip", "batchSize", "maxTimeMS", "count"}
 
 // Model the action requested from client to perform on mongodb.
 type mongoRequest struct {
@@ -24,17 +46,52 @@ type mongoRequest struct {
 	Collection string
 	// mydb.mycoll.action(args1, args2, args3)
 	Action string
+	// Field name, first argument of distinct
+	Key string
+	// Sort fields of findAndModify and its variants
+	Sort []string
 	// FIXME convert into one slice?
 	Args1 map[string]interface{}
 	Args2 map[string]interface{}
 	Args3 map[string]interface{}
 	// Unmarshaled Json data passed as request body
 	JsonPayloadSlice []interface{}
-	// FIXME convert into one slice?
-	SubAction1 string
-	SubArgs1   string
-	SubAction2 string
-	SubArgs2   string
+	// Stages of aggregate, from url or request body
+	Pipeline []interface{}
+	// Url parameters
+	Params url.Values
+	// Render results as canonical Extended JSON, relaxed otherwise
+	Canonical bool
+	// Stream cursor results as newline delimited JSON
+	NDJSON bool
+	// Keyset pagination of find, see pagination.go
+	Paginate bool
+	After    *pageToken
+	// Return a server side cursor, see cursors.go
+	Cursor bool
+	// Write concern overriding server default, see writeconcern.go
+	WriteConcern *writeConcern
+	// Read preference overriding server default, see readpref.go
+	ReadPreference *readPreference
+	// Cursor modifiers in the order they appear in the query.
+	SubActions []cursorModifier
+	// Pagination applied to the cursor, reported back in response headers.
+	Skip  int
+	Limit int
+	// Session used by the request, it must outlive
+	// cursors that are streamed to the client.
+	session *mgo.Session
+	// Authenticated client, nil when authentication is disabled.
+	client *principal
+	// Fields to redact or mask in returned documents, see redact.go
+	fields *fieldRules
+}
+
+// cursorModifier models a sub action applied to the cursor
+// returned by the main action (es. sort, limit).
+type cursorModifier struct {
+	Action string
+	Args   string
 }
 
 // Check if decoded action is sopported and coherent with http method
@@ -48,136 +105,459 @@ func (s *mongoRequest) Check(r *http.Request) error {
 	if !isSupported {
 		return fmt.Errorf("%s action is invalid or not supported", s.Action)
 	}
-	isSupported = false
-	for _, v := range supportedSubActions {
-		if s.SubAction1 == v {
-			isSupported = true
+	seen := map[string]bool{}
+	for i, sub := range s.SubActions {
+		isSupported = false
+		for _, v := range supportedSubActions {
+			if sub.Action == v {
+				isSupported = true
+			}
+		}
+		if !isSupported {
+			return fmt.Errorf("%s action is invalid or not supported", sub.Action)
+		}
+		if seen[sub.Action] {
+			return fmt.Errorf("%s specified more than once", sub.Action)
+		}
+		seen[sub.Action] = true
+		if s.Action != "find" {
+			return fmt.Errorf("%s cannot be applied to %s", sub.Action, s.Action)
+		}
+		if sub.Action == "count" {
+			if i != len(s.SubActions)-1 {
+				return fmt.Errorf("count must be the last action of the query")
+			}
+			if args := strings.TrimSpace(sub.Args); !(args == "" || args == "true" || args == "false") {
+				return fmt.Errorf("count argument must be true or false")
+			}
 		}
 	}
-	if !isSupported {
-		return fmt.Errorf("%s action is invalid or not supported", s.SubAction1)
+	if (s.Action == "find" || s.Action == "findOne") && s.Args2 != nil {
+		if err := checkProjection(s.Args2); err != nil {
+			return err
+		}
 	}
-	isSupported = false
-	for _, v := range supportedSubActions {
-		if s.SubAction2 == v {
-			isSupported = true
+	if s.Action == "aggregate" {
+		if err := checkAggregate(s); err != nil {
+			return err
 		}
 	}
-	if !isSupported {
-		return fmt.Errorf("%s action is invalid or not supported", s.SubAction2)
+	if s.Paginate {
+		if err := checkPagination(s); err != nil {
+			return err
+		}
 	}
-	switch r.Method {
-	case "GET":
-		if !(s.Action == "find" || s.Action == "count") {
-			return fmt.Errorf("Action %s not coherent with http method", s.Action)
+	if s.Cursor {
+		if err := checkCursor(s); err != nil {
+			return err
 		}
-	case "POST":
-		if s.Action != "insert" {
-			return fmt.Errorf("Action %s not coherent with http method", s.Action)
+	}
+	// Options read when the write is executed
+	switch s.Action {
+	case "remove":
+		if _, err := boolOption(s.Args2, "justOne"); err != nil {
+			return err
 		}
-	case "DELETE":
-		if s.Action != "remove" {
-			return fmt.Errorf("Action %s not coherent with http method", s.Action)
+	case "update":
+		for _, key := range []string{"upsert", "multi"} {
+			if _, err := boolOption(s.Args3, key); err != nil {
+				return err
+			}
 		}
-	case "PUT":
-		if s.Action != "update" {
-			return fmt.Errorf("Action %s not coherent with http method", s.Action)
+	}
+	if s.Action == "insert" {
+		if _, err := insertOrdered(s); err != nil {
+			return err
+		}
+		if s.JsonPayloadSlice != nil && len(s.JsonPayloadSlice) == 0 {
+			return fmt.Errorf("No documents to insert")
 		}
-	default:
-		return fmt.Errorf("Action %s not coherent with http method", s.Action)
+	}
+	allowed := actionMethods[s.Action]
+	if _, ok := modifyOptionsArg[s.Action]; ok {
+		spec, err := getModifySpec(s)
+		if err != nil {
+			return err
+		}
+		// findAndModify removing documents needs DELETE, PUT otherwise
+		if s.Action == "findAndModify" {
+			allowed = []string{"PUT"}
+			if spec.Change.Remove {
+				allowed = []string{"DELETE"}
+			}
+		}
+	}
+	for _, method := range allowed {
+		if r.Method == method {
+			return nil
+		}
+	}
+	return methodNotAllowed(s.Action, allowed)
+}
+
+// checkProjection validates a find() projection document.
+// As in mongodb inclusion and exclusion cannot be mixed,
+// except for _id which can always be excluded.
+func checkProjection(projection map[string]interface{}) error {
+	included, excluded := false, false
+	for k, v := range projection {
+		switch vv := v.(type) {
+		case bool:
+			if vv {
+				included = true
+			} else if k != "_id" {
+				excluded = true
+			}
+		case int, int64, float64:
+			if n, _ := toFloat64(vv); n != 0 {
+				included = true
+			} else if k != "_id" {
+				excluded = true
+			}
+		case map[string]interface{}:
+			for op := range vv {
+				if !(op == "$slice" || op == "$elemMatch" || op == "$meta") {
+					return fmt.Errorf("Unsupported projection operator %s on %s", op, k)
+				}
+			}
+		default:
+			return fmt.Errorf("Invalid projection value for %s", k)
+		}
+	}
+	if included && excluded {
+		return fmt.Errorf("Projection cannot mix inclusion and exclusion")
 	}
 	return nil
 }
 
+// checkAggregate validates pipeline and options of aggregate.
+func checkAggregate(s *mongoRequest) error {
+	if len(s.Pipeline) == 0 {
+		return fmt.Errorf("aggregate requires a pipeline")
+	}
+	for i, stage := range s.Pipeline {
+		if _, ok := stage.(map[string]interface{}); !ok {
+			return fmt.Errorf("Stage %d of pipeline must be a document", i)
+		}
+	}
+	for k, v := range s.Args1 {
+		switch k {
+		case "allowDiskUse":
+			if _, ok := v.(bool); !ok {
+				return fmt.Errorf("allowDiskUse must be a boolean")
+			}
+		case "batchSize":
+			if n, ok := toInt64(v); !ok || n < 0 {
+				return fmt.Errorf("batchSize must be a non-negative integer")
+			}
+		default:
+			return fmt.Errorf("Unsupported aggregate option %s", k)
+		}
+	}
+	return nil
+}
+
+// getPipelineArg decodes pipeline passed as first argument of aggregate.
+// Remaining arguments are returned.
+func getPipelineArg(call callExpr) ([]interface{}, []callArg) {
+	if len(call.Args) == 0 {
+		return nil, nil
+	}
+	pipeline, ok := call.Args[0].Value.([]interface{})
+	if !ok {
+		return nil, call.Args
+	}
+	return pipeline, call.Args[1:]
+}
+
+// boolOption decodes a boolean option, 1 and 0 are accepted too.
+func boolOption(opts map[string]interface{}, key string) (bool, error) {
+	switch v := opts[key].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case int, int64, float64:
+		if n, _ := toFloat64(v); n == 0 || n == 1 {
+			return n == 1, nil
+		}
+	}
+	return false, fmt.Errorf("%s must be a boolean", key)
+}
+
+// docOption decodes an option which must be a document.
+func docOption(opts map[string]interface{}, key string) (map[string]interface{}, error) {
+	switch v := opts[key].(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s must be a document", key)
+}
+
 // getActionArgs helps to decode mongodb functions and arguments.
 // This is used for find, insert, update.
-func getActionArgs(s string) (action string, args1, args2, args3 map[string]interface{}, er error) {
+func getActionArgs(call callExpr) (action string, args1, args2, args3 map[string]interface{}, er error) {
 	argsPointerSlice := []*map[string]interface{}{&args1, &args2, &args3}
-	actiond := strings.Split(s, "(")
-	action = actiond[0]
-	args := strings.Trim(actiond[1], ")")
-	if len(args) == 0 {
+	action = call.Name
+	if len(call.Args) > len(argsPointerSlice) {
+		er = &syntaxError{Offset: call.Args[len(argsPointerSlice)].Pos, Msg: "too many arguments for " + action}
 		return
 	}
-	argsSlice := strings.SplitAfter(args, "},")
-	for i, v := range argsSlice {
-		v = strings.TrimRight(v, ",")
-		// Here we dont need to args1.assert(map[string]interface{})
-		// becuse we dont pass interface{} to Unmarshal but the right type.
-		err := json.Unmarshal([]byte(v), argsPointerSlice[i])
-		if err != nil {
-			er = err
+	for i, arg := range call.Args {
+		if arg.Value == nil {
+			continue
+		}
+		doc, ok := arg.Value.(map[string]interface{})
+		if !ok {
+			er = &syntaxError{Offset: arg.Pos, Msg: "argument of " + action + " must be a document"}
 			return
 		}
+		*argsPointerSlice[i] = doc
 	}
 	return
 }
 
+// getKeyArg decodes the string literal passed as first argument
+// to functions like distinct("<field>", <query>).
+// Remaining arguments are returned.
+func getKeyArg(call callExpr) (string, []callArg, error) {
+	if len(call.Args) == 0 {
+		return "", nil, &syntaxError{Offset: call.Pos + len(call.Name) + 1, Msg: call.Name + " requires a field name"}
+	}
+	key, ok := call.Args[0].Value.(string)
+	if !ok || key == "" {
+		return "", nil, &syntaxError{Offset: call.Args[0].Pos, Msg: "first argument of " + call.Name + " must be a field name"}
+	}
+	if len(call.Args) > 2 {
+		return "", nil, &syntaxError{Offset: call.Args[2].Pos, Msg: "too many arguments for " + call.Name}
+	}
+	return key, call.Args[1:], nil
+}
+
 // getSubActionArgs helps to decode mongodb functions and its arguments.
-// This is used for sort, limit
-func getSubActionArgs(s string) (action, args string) {
-	actiond := strings.Split(s, "(")
-	action = actiond[0]
-	args = strings.Trim(actiond[1], ")")
-	return
+// This is used for cursor modifiers (es. sort, limit).
+func getSubActionArgs(call callExpr) (cursorModifier, error) {
+	sub := cursorModifier{Action: call.Name}
+	if len(call.Args) > 1 {
+		return sub, &syntaxError{Offset: call.Args[1].Pos, Msg: "too many arguments for " + sub.Action}
+	}
+	if len(call.Args) == 1 {
+		sub.Args = call.Args[0].Raw
+	}
+	return sub, nil
+}
+
+// requestQuery extracts the query string, es. mydb.mycoll.find(),
+// from the requested uri. Url parameters are dropped and
+// escaped characters are decoded.
+func requestQuery(r *http.Request) (string, error) {
+	uri := r.RequestURI
+	if uri == "" && r.URL != nil {
+		uri = r.URL.RequestURI()
+	}
+	uri = strings.TrimPrefix(uri, "/")
+	if i := strings.Index(uri, "?"); i >= 0 {
+		uri = uri[:i]
+	}
+	return url.PathUnescape(uri)
 }
 
-// unmarshalPayload gets json data passed as body and unmarshal it.
-// Works on raw []byte to avoing string conversion overhead.
+// unmarshalPayload gets documents passed as request body,
+// either JSON (see decodeDocuments) or NDJSON.
 func unmarshalPayload(r *http.Request) ([]interface{}, error) {
-	if r.ContentLength > 0 {
-		interfaceSlice := []interface{}{}
-		data := make([]byte, r.ContentLength)
-		r.Body.Read(data)
-		// [][]byte
-		splittedByteData := bytes.SplitAfter(data, []byte("},"))
-		for _, single := range splittedByteData {
-			var mData interface{}
-			single = bytes.TrimRight(single, ",")
-			err := json.Unmarshal(single, &mData)
-			if err != nil {
-				return nil, err
+	if r.Body == nil {
+		return nil, nil
+	}
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		return unmarshalNDJSON(r.Body)
+	}
+	return decodeDocuments(r.Body)
+}
+
+// unmarshalNDJSON decodes a body with one document per line.
+// Blank lines are skipped.
+func unmarshalNDJSON(body io.Reader) ([]interface{}, error) {
+	if body == nil {
+		return nil, nil
+	}
+	docs := []interface{}{}
+	reader := bufio.NewReader(body)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			doc, perr := parseValueString(string(line))
+			if perr != nil {
+				return nil, fmt.Errorf("Line %d: %v", n, perr)
 			}
-			interfaceSlice = append(interfaceSlice, mData)
+			if _, ok := doc.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("Line %d: not a document", n)
+			}
+			docs = append(docs, doc)
+		}
+		if err == io.EOF {
+			return docs, nil
 		}
-		return interfaceSlice, nil
 	}
-	return nil, nil
 }
 
-func (s *mongoRequest) Decode(r *http.Request) error {
-	mongoQuery := strings.Split(r.RequestURI, "/")[1]
-	parameters := strings.Split(mongoQuery, ".")
-	if len(parameters) < 3 {
-		return fmt.Errorf("Too few arguments")
-	} else if len(parameters) > 5 {
-		return fmt.Errorf("Too much arguments")
-	}
-	for i, v := range parameters {
-		switch i {
-		case 0:
-			s.Database = v
-		case 1:
-			s.Collection = v
-		// mongodb main function (find, insert etc)
-		case 2:
-			var err error
-			s.Action, s.Args1, s.Args2, s.Args3, err = getActionArgs(v)
-			if err != nil {
-				return err
-			}
-			s.JsonPayloadSlice, err = unmarshalPayload(r)
-			if err != nil {
-				return err
+// isNDJSON tells if media type, es. from Content-Type header, is NDJSON.
+func isNDJSON(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	return err == nil && mediaType == ndjsonMediaType
+}
+
+// acceptsNDJSON tells if client asked for NDJSON in Accept header.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isNDJSON(accepted) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalPipeline gets aggregate pipeline passed as body.
+func unmarshalPipeline(r *http.Request) ([]interface{}, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	value, err := parseValueString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	pipeline, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Pipeline must be an array of stages")
+	}
+	return pipeline, nil
+}
+
+// requestParams returns url parameters of the request.
+func requestParams(r *http.Request) url.Values {
+	uri := r.RequestURI
+	if uri == "" && r.URL != nil {
+		return r.URL.Query()
+	}
+	if i := strings.Index(uri, "?"); i >= 0 {
+		params, _ := url.ParseQuery(uri[i+1:])
+		return params
+	}
+	return url.Values{}
+}
+
+// extJSONMode tells if canonical Extended JSON is requested, either
+// with extjson url parameter or with Accept header
+// (es. Accept: application/json; extjson=canonical).
+func extJSONMode(r *http.Request, params url.Values) (bool, error) {
+	mode := params.Get("extjson")
+	if mode == "" {
+		for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, mediaParams, err := mime.ParseMediaType(accepted)
+			if err == nil && mediaType == "application/json" && mediaParams["extjson"] != "" {
+				mode = mediaParams["extjson"]
+				break
 			}
-		//sub action (es sort, limit)
-		case 3:
-			s.SubAction1, s.SubArgs1 = getSubActionArgs(v)
-		//sub action (es sort, limit)
-		case 4:
-			s.SubAction2, s.SubArgs2 = getSubActionArgs(v)
 		}
 	}
+	switch mode {
+	case "", "relaxed":
+		return false, nil
+	case "canonical":
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid Extended JSON mode %s", mode)
+}
+
+// marshal renders results as Extended JSON in the requested mode.
+func (s *mongoRequest) marshal(v interface{}) ([]byte, error) {
+	return marshalExtJSON(v, s.Canonical)
+}
+
+func (s *mongoRequest) Decode(r *http.Request) error {
+	mongoQuery, err := requestQuery(r)
+	if err != nil {
+		return err
+	}
+	s.Params = requestParams(r)
+	s.Canonical, err = extJSONMode(r, s.Params)
+	if err != nil {
+		return err
+	}
+	s.NDJSON = acceptsNDJSON(r)
+	s.Paginate, s.After, err = pageParams(s.Params)
+	if err != nil {
+		return err
+	}
+	s.ReadPreference, err = getReadPreference(s.Params)
+	if err != nil {
+		return err
+	}
+	if v := s.Params.Get("cursor"); v != "" {
+		if s.Cursor, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cursor must be true or false")
+		}
+	}
+	expr, err := parseQuery(mongoQuery)
+	if err != nil {
+		return err
+	}
+	s.Database = expr.Database
+	s.Collection = expr.Collection
+	// mongodb main function (find, insert etc)
+	action := expr.Calls[0]
+	if action.Name == "distinct" {
+		s.Key, action.Args, err = getKeyArg(action)
+		if err != nil {
+			return err
+		}
+	}
+	if action.Name == "aggregate" {
+		s.Pipeline, action.Args = getPipelineArg(action)
+	}
+	s.Action, s.Args1, s.Args2, s.Args3, err = getActionArgs(action)
+	if err != nil {
+		return err
+	}
+	if i, ok := modifyOptionsArg[s.Action]; ok && i < len(action.Args) {
+		s.Sort, err = getSortOption(action.Args[i])
+		if err != nil {
+			return err
+		}
+	}
+	if s.Action == "aggregate" {
+		if s.Pipeline == nil {
+			s.Pipeline, err = unmarshalPipeline(r)
+		}
+	} else {
+		s.JsonPayloadSlice, err = unmarshalPayload(r)
+	}
+	if err != nil {
+		return err
+	}
+	s.WriteConcern, err = getWriteConcern(s, r)
+	if err != nil {
+		return err
+	}
+	// sub actions (es sort, limit)
+	for _, call := range expr.Calls[1:] {
+		sub, err := getSubActionArgs(call)
+		if err != nil {
+			return err
+		}
+		s.SubActions = append(s.SubActions, sub)
+	}
 	if DEBUG {
 		log.Printf("[DEBUG] %+v\n", s)
 	}
@@ -185,35 +565,74 @@ func (s *mongoRequest) Decode(r *http.Request) error {
 }
 
 // decodeSortArgs decodes json sort argumets to be passed to mgo Sort().
-func decodeSortArgs(s string) []string {
-	// FIXME parse $natural key
+// Keys are returned in the same order of the sort document.
+func decodeSortArgs(s string) ([]string, error) {
 	returnValue := []string{}
-	glob := new(map[string]interface{})
-	if len(s) != 0 {
-		err := json.Unmarshal([]byte(s), glob)
-		if err != nil {
-			return []string{""}
-		}
-		for k, v := range *glob {
-			i := v.(float64)
-			if int(i) < 0 {
-				k := "-" + k
+	if len(strings.TrimSpace(s)) == 0 {
+		return returnValue, nil
+	}
+	value, err := parseOrderedValueString(s)
+	if err != nil {
+		return nil, err
+	}
+	spec, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("Sort argument must be a document")
+	}
+	return sortFields(spec)
+}
+
+// sortFields converts a sort document into mgo Sort() fields.
+func sortFields(spec bson.D) ([]string, error) {
+	returnValue := []string{}
+	for _, elem := range spec {
+		k := elem.Name
+		switch v := elem.Value.(type) {
+		case int, int64, float64:
+			if n, _ := toFloat64(v); n == 1 {
 				returnValue = append(returnValue, k)
+			} else if n == -1 {
+				returnValue = append(returnValue, "-"+k)
 			} else {
-				returnValue = append(returnValue, k)
+				return nil, fmt.Errorf("Invalid sort direction for %s, must be 1 or -1", k)
+			}
+		case bson.D:
+			// {"score":{"$meta":"textScore"}}
+			if len(v) != 1 || v[0].Name != "$meta" || v[0].Value != "textScore" {
+				return nil, fmt.Errorf("Invalid sort direction for %s, only textScore $meta is supported", k)
 			}
+			returnValue = append(returnValue, "$textScore:"+k)
+		default:
+			return nil, fmt.Errorf("Invalid sort direction for %s, must be 1 or -1", k)
 		}
 	}
-	return returnValue
+	return returnValue, nil
 }
 
 // bakeAction setups the query to exucute primary action
 func bakeAction(queryP **mgo.Query, s *mongoRequest, coll *mgo.Collection) error {
 	switch s.Action {
-	case "find":
+	case "find", "findOne":
+		*queryP = coll.Find(pageCriteria(s))
+		if s.Args2 != nil {
+			*queryP = (*queryP).Select(s.Args2)
+		}
+		return nil
+	case "count", "distinct":
 		*queryP = coll.Find(s.Args1)
 		return nil
-	case "count":
+	case "findAndModify", "findOneAndUpdate", "findOneAndDelete":
+		spec, err := getModifySpec(s)
+		if err != nil {
+			return err
+		}
+		*queryP = coll.Find(spec.Query)
+		if len(s.Sort) > 0 {
+			*queryP = (*queryP).Sort(s.Sort...)
+		}
+		if spec.Fields != nil {
+			*queryP = (*queryP).Select(spec.Fields)
+		}
 		return nil
 	case "insert":
 		return nil
@@ -224,42 +643,65 @@ func bakeAction(queryP **mgo.Query, s *mongoRequest, coll *mgo.Collection) error
 	}
 }
 
+// subAction returns the requested cursor modifier with the given name.
+func (s *mongoRequest) subAction(action string) (cursorModifier, bool) {
+	for _, sub := range s.SubActions {
+		if sub.Action == action {
+			return sub, true
+		}
+	}
+	return cursorModifier{}, false
+}
+
 // bakeSubActions setup the query to exucute secondary actions.
+// Modifiers are applied in the order they were requested.
 func bakeSubActions(queryP **mgo.Query, s *mongoRequest, coll *mgo.Collection) error {
 	// No subactions on this
 	if s.Action != "find" {
 		return nil
 	}
-	if s.SubAction1 != "" {
-		switch s.SubAction1 {
-		case "sort":
-			*queryP = queryP.Sort(decodeSortArgs(s.SubArgs1)...)
-		case "limit":
-			num, err := strconv.Atoi(s.SubArgs1)
+	// As in mongo shell count ignores skip and limit
+	// unless applySkipLimit is true.
+	count, counting := s.subAction("count")
+	applySkipLimit := !counting || strings.TrimSpace(count.Args) == "true"
+	for _, sub := range s.SubActions {
+		if sub.Action == "count" {
+			continue
+		}
+		if (sub.Action == "limit" || sub.Action == "skip") && !applySkipLimit {
+			continue
+		}
+		if sub.Action == "sort" {
+			fields, err := decodeSortArgs(sub.Args)
 			if err != nil {
-				return fmt.Errorf("Unable to convert limit argument")
-			} else {
-				*queryP = queryP.Limit(num)
+				return err
 			}
-		default:
-			return fmt.Errorf("Unable to execute %s", s.SubAction1)
+			*queryP = (*queryP).Sort(fields...)
+			continue
 		}
-	}
-	if s.SubAction2 != "" {
-		switch s.SubAction2 {
-		case "sort":
-			*queryP = queryP.Sort(decodeSortArgs(s.SubArgs2)...)
-			return nil
+		num, err := strconv.Atoi(strings.TrimSpace(sub.Args))
+		if err != nil {
+			return fmt.Errorf("Unable to convert %s argument", sub.Action)
+		}
+		switch sub.Action {
 		case "limit":
-			num, err := strconv.Atoi(s.SubArgs2)
-			if err != nil {
-				return fmt.Errorf("Unable to convert limit argument")
-			} else {
-				*queryP = queryP.Limit(num)
-				return nil
+			*queryP = (*queryP).Limit(num)
+			s.Limit = num
+		case "skip":
+			if num < 0 {
+				return fmt.Errorf("skip argument must be non-negative")
 			}
+			*queryP = (*queryP).Skip(num)
+			s.Skip = num
+		case "batchSize":
+			*queryP = (*queryP).Batch(num)
+		case "maxTimeMS":
+			if num < 0 {
+				return fmt.Errorf("maxTimeMS argument must be non-negative")
+			}
+			*queryP = (*queryP).SetMaxTime(time.Duration(num) * time.Millisecond)
 		default:
-			return fmt.Errorf("Unable to execute %s", s.SubAction1)
+			return fmt.Errorf("Unable to execute %s", sub.Action)
 		}
 	}
 	return nil
@@ -267,73 +709,89 @@ func bakeSubActions(queryP **mgo.Query, s *mongoRequest, coll *mgo.Collection) e
 
 // executeQuery exectutes query on mongodb
 func executeQuery(query *mgo.Query, s *mongoRequest, coll *mgo.Collection) (interface{}, error) {
-	gdata := new([]interface{})
 	switch s.Action {
 	case "find":
-		err := query.All(gdata)
-		if err != nil {
-			return []byte{}, err
-		}
-		return json.Marshal(gdata)
-	case "insert":
-		payloadLen := len(s.JsonPayloadSlice)
-		if payloadLen > 0 {
-			err := coll.Insert(s.JsonPayloadSlice...)
-			if err != nil {
-				return []byte{}, err
-			}
-			res := fmt.Sprintf("{\"nInserted\":%d}", payloadLen)
-			return []byte(res), nil
-		} else {
-			err := coll.Insert(s.Args1)
+		if _, ok := s.subAction("count"); ok {
+			n, err := query.Count()
 			if err != nil {
 				return []byte{}, err
 			}
-			return []byte(`{"nInserted":1}`), nil
+			return strconv.Itoa(n), nil
+		}
+		if s.Paginate {
+			return executePage(query, s)
+		}
+		if s.Cursor {
+			return openCursor(query.Iter(), s)
+		}
+		return query.Iter(), nil
+	case "findOne":
+		doc := bson.M{}
+		err := query.One(&doc)
+		if err != nil {
+			return []byte{}, err
+		}
+		s.fields.apply(doc)
+		return s.marshal(doc)
+	case "distinct":
+		values := []interface{}{}
+		err := query.Distinct(s.Key, &values)
+		if err != nil {
+			return []byte{}, err
+		}
+		return s.marshal(values)
+	case "findAndModify", "findOneAndUpdate", "findOneAndDelete":
+		return executeModify(query, s)
+	case "aggregate":
+		pipe := coll.Pipe(s.Pipeline)
+		if v, ok := s.Args1["allowDiskUse"]; ok && v.(bool) {
+			pipe = pipe.AllowDiskUse()
+		}
+		if v, ok := s.Args1["batchSize"]; ok {
+			n, _ := toInt64(v)
+			pipe = pipe.Batch(int(n))
 		}
+		if s.Cursor {
+			return openCursor(pipe.Iter(), s)
+		}
+		return pipe.Iter(), nil
+	case "insert":
+		return executeInsert(s, coll)
 	case "remove":
-		if v, ok := s.Args2["justOne"]; ok && v.(float64) == 1 {
+		if justOne, _ := boolOption(s.Args2, "justOne"); justOne {
 			err := coll.Remove(s.Args1)
 			if err != nil {
 				return []byte{}, err
 			}
-			return []byte(`{"nRemoved":1}`), nil
+			return s.writeResult(changeResult(s, &mgo.ChangeInfo{Removed: 1}))
 		}
 		info, err := coll.RemoveAll(s.Args1)
 		if err != nil {
 			return []byte{}, err
 		}
-		returnString := fmt.Sprintf("{\"nRemoved\":%d}", info.Removed)
-		return []byte(returnString), nil
+		return s.writeResult(changeResult(s, info))
 	case "update":
-		if v, ok := s.Args3["upsert"]; ok && v.(float64) == 1 {
-			var returnString string
+		if upsert, _ := boolOption(s.Args3, "upsert"); upsert {
 			info, err := coll.Upsert(s.Args1, s.Args2)
 			if err != nil {
 				return []byte{}, err
 			}
-			if info.Updated != 0 {
-				returnString = `{"nModified":1}`
-			} else {
-				returnString = `{"nUpserted":1}`
-			}
-			return []byte(returnString), nil
+			return s.writeResult(changeResult(s, info))
 		}
-		if v, ok := s.Args3["multi"]; ok && v.(float64) == 1 {
+		if multi, _ := boolOption(s.Args3, "multi"); multi {
 			info, err := coll.UpdateAll(s.Args1, s.Args2)
 			if err != nil {
 				return []byte{}, err
 			}
-			returnString := fmt.Sprintf("{\"nModified\":%d}", info.Updated)
-			return []byte(returnString), nil
+			return s.writeResult(changeResult(s, info))
 		}
 		err := coll.Update(s.Args1, s.Args2)
 		if err != nil {
 			return []byte{}, err
 		}
-		return []byte(`{"nModified":1}`), nil
+		return s.writeResult(changeResult(s, &mgo.ChangeInfo{Updated: 1}))
 	case "count":
-		n, err := coll.Count()
+		n, err := query.Count()
 		if err != nil {
 			return []byte{}, err
 		}
@@ -346,18 +804,45 @@ func executeQuery(query *mgo.Query, s *mongoRequest, coll *mgo.Collection) (inte
 
 // Performs decoded action on mongodb.
 func (s *mongoRequest) Execute(msession *mgo.Session, r *http.Request) (interface{}, error) {
-	// FIXME add session to mongoRequest struct?
-	// TODO test copy/clone/new against consistency modes
 	err := s.Decode(r)
 	if err != nil {
-		return nil, err
+		return nil, badRequest(err)
+	}
+	if err := limits.check(s); err != nil {
+		return nil, badRequest(err)
+	}
+	s.client = principalFrom(r.Context())
+	if policy != nil {
+		if err := policy.authorize(s.client, s); err != nil {
+			return nil, err
+		}
+		// Field rules check client criteria, before filters are added
+		if err := policy.applyFieldRules(s.client, s); err != nil {
+			return nil, err
+		}
+		if err := policy.applyRowFilters(s.client, s); err != nil {
+			return nil, err
+		}
+	}
+	// A copy keeps consistency mode, read preference
+	// and write concern of msession, unless overridden.
+	s.session = msession.Copy()
+	if s.ReadPreference != nil {
+		s.ReadPreference.apply(s.session)
 	}
-	session := msession.Copy()
-	defer session.Close()
-	coll := session.DB(s.Database).C(s.Collection)
+	if s.WriteConcern != nil {
+		s.session.SetSafe(s.WriteConcern.Safe)
+	}
+	coll := s.session.DB(s.Database).C(s.Collection)
 	query := new(mgo.Query)
-	bakeAction(&query, s, coll)
-	bakeSubActions(&query, s, coll)
+	err = bakeAction(&query, s, coll)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	err = bakeSubActions(&query, s, coll)
+	if err != nil {
+		return nil, badRequest(err)
+	}
 	jdata, err := executeQuery(query, s, coll)
 	if err != nil {
 		return nil, err
@@ -365,23 +850,52 @@ func (s *mongoRequest) Execute(msession *mgo.Session, r *http.Request) (interfac
 	return jdata, nil
 }
 
+// Close releases the session of the request.
+func (s *mongoRequest) Close() {
+	if s.session != nil {
+		s.session.Close()
+		s.session = nil
+	}
+}
+
+// setPaginationHeaders reports skip and limit applied to a find.
+func setPaginationHeaders(w http.ResponseWriter, s *mongoRequest) {
+	if _, ok := s.subAction("count"); ok || s.Action != "find" {
+		return
+	}
+	w.Header().Set("X-Pagination-Skip", strconv.Itoa(s.Skip))
+	if s.Limit != 0 {
+		w.Header().Set("X-Pagination-Limit", strconv.Itoa(s.Limit))
+	}
+}
+
 func MakeMainHandler(msession *mgo.Session) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
 				log.Printf("[ERROR] on: %v got: %v\n", *r, err)
+				writeError(w, &apiError{Status: http.StatusInternalServerError, Code: "InternalError", Message: "Internal server error"})
 			}
 		}()
 		if DEBUG {
 			log.Printf("[DEBUG] Request struct: %+v\n", r)
 		}
 		mReq := mongoRequest{}
+		defer mReq.Close()
 		iData, err := mReq.Execute(msession, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
+		setPaginationHeaders(w, &mReq)
 		switch aData := iData.(type) {
+		case *mgo.Iter:
+			if err := streamDocuments(w, r, aData, &mReq); err != nil {
+				writeError(w, err)
+			}
+		case *resultPage:
+			setNextPageHeaders(w, r, &mReq, aData)
+			streamDocuments(w, r, aData, &mReq)
 		case string:
 			w.Header().Set("Content-Type", "text/plain")
 			fmt.Fprintf(w, "%s\n", aData)
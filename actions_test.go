@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -24,15 +27,147 @@ func compareSortSlices(o, p []string) bool {
 }
 
 func TestDecodeSortArgs(t *testing.T) {
-	// TODO add $natural case
-	cases := []decodeSortCase{}
-	oneCase := decodeSortCase{`{"name":-1,"age":1}`, []string{"-name", "age"}}
-	cases = append(cases, oneCase)
+	cases := []decodeSortCase{
+		{`{"name":-1,"age":1}`, []string{"-name", "age"}},
+		{`{"age":1,"name":-1,"city":1}`, []string{"age", "-name", "city"}},
+		{`{"$natural":-1}`, []string{"-$natural"}},
+		{`{"score":{"$meta":"textScore"},"name":1}`, []string{"$textScore:score", "name"}},
+		{``, []string{}},
+	}
+	for _, singleCase := range cases {
+		got, err := decodeSortArgs(singleCase.Case)
+		if err != nil || !compareSortSlices(got, singleCase.Expected) {
+			if testing.Verbose() {
+				fmt.Printf("expected: %+v\n", singleCase)
+				fmt.Printf("got: %+v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+	for _, invalid := range []string{`{"name":2}`, `{"name":"asc"}`, `{"score":{"$meta":"other"}}`, `[1]`, `{"name":1`} {
+		if _, err := decodeSortArgs(invalid); err == nil {
+			if testing.Verbose() {
+				fmt.Printf("expected error for: %s\n", invalid)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type checkProjectionCase struct {
+	Case map[string]interface{}
+	// Expect an error for this projection
+	Invalid bool
+}
+
+func TestCheckProjection(t *testing.T) {
+	cases := []checkProjectionCase{
+		{map[string]interface{}{"name": float64(1), "_id": float64(0)}, false},
+		{map[string]interface{}{"name": false, "age": float64(0)}, false},
+		{map[string]interface{}{"tags": map[string]interface{}{"$slice": float64(5)}, "name": true}, false},
+		{map[string]interface{}{"name": float64(1), "age": float64(0)}, true},
+		{map[string]interface{}{"name": "yes"}, true},
+		{map[string]interface{}{"tags": map[string]interface{}{"$where": "1"}}, true},
+	}
+	for _, singleCase := range cases {
+		err := checkProjection(singleCase.Case)
+		if (err != nil) != singleCase.Invalid {
+			if testing.Verbose() {
+				fmt.Printf("case: %+v\n", singleCase)
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type unmarshalNDJSONCase struct {
+	Case     string
+	Expected []interface{}
+	// Expect an error for this body
+	Invalid bool
+}
+
+func TestUnmarshalNDJSON(t *testing.T) {
+	cases := []unmarshalNDJSONCase{
+		{"{\"a\":{\"b\":1}},\n\n{\"c\":[{\"d\":2}]}", nil, true},
+		{"{\"a\":{\"b\":1}}\r\n\n{\"c\":[{\"d\":2}]}", []interface{}{
+			map[string]interface{}{"a": map[string]interface{}{"b": 1}},
+			map[string]interface{}{"c": []interface{}{map[string]interface{}{"d": 2}}},
+		}, false},
+		{"{name:'Zaphod'}\n", []interface{}{map[string]interface{}{"name": "Zaphod"}}, false},
+		{"", []interface{}{}, false},
+		{"{\"a\":1}\n[1,2]\n", nil, true},
+	}
+	for _, singleCase := range cases {
+		got, err := unmarshalNDJSON(strings.NewReader(singleCase.Case))
+		if (err != nil) != singleCase.Invalid || (err == nil && !reflect.DeepEqual(got, singleCase.Expected)) {
+			if testing.Verbose() {
+				fmt.Printf("case: %q\n", singleCase.Case)
+				fmt.Printf("got: %#v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type writeOptionsCase struct {
+	Method string
+	Query  string
+	// Expect an error for this request
+	Invalid bool
+}
+
+func TestCheckWriteOptions(t *testing.T) {
+	cases := []writeOptionsCase{
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":true})`, false},
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":0})`, false},
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":"yes"})`, true},
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":"true"})`, true},
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":2})`, true},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"upsert":1,"multi":false})`, false},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"upsert":"true"})`, true},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"multi":2})`, true},
+	}
 	for _, singleCase := range cases {
-		got := decodeSortArgs(singleCase.Case)
-		if !compareSortSlices(got, singleCase.Expected) && testing.Verbose() {
-			fmt.Printf("expected: %+v\n", singleCase)
-			fmt.Printf("got: %+v\n", got)
+		s := &mongoRequest{}
+		err := s.Decode(&http.Request{Method: singleCase.Method, RequestURI: singleCase.Query})
+		if (err != nil) != singleCase.Invalid {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %s\n", singleCase.Method, singleCase.Query)
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type distinctArgsCase struct {
+	Query string
+	// Offset of the syntax error, -1 if valid
+	Offset int
+}
+
+func TestDistinctArgs(t *testing.T) {
+	cases := []distinctArgsCase{
+		{`/db.coll.distinct("a")`, -1},
+		{`/db.coll.distinct("a",{"b":1})`, -1},
+		{`/db.coll.distinct()`, 17},
+		{`/db.coll.distinct(1)`, 17},
+		{`/db.coll.distinct("a",{"b":1},{"x":1})`, 29},
+	}
+	for _, singleCase := range cases {
+		s := &mongoRequest{}
+		err := s.Decode(&http.Request{Method: "GET", RequestURI: singleCase.Query})
+		offset := -1
+		if e, ok := err.(*syntaxError); ok {
+			offset = e.Offset
+		}
+		if offset != singleCase.Offset || (err != nil && offset == -1) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s\n", singleCase.Query)
+				fmt.Printf("got: %v %d\n", err, offset)
+			}
 			t.Fail()
 		}
 	}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authentication of clients. Every request must carry credentials
+// accepted by one of the configured authenticators:
+// static API keys (X-API-Key header), HTTP Basic against a bcrypt
+// credentials file, a JWT bearer token signed with HS256 or RS256
+// or a TLS client certificate.
+
+// principal is the authenticated client of a request.
+type principal struct {
+	// API key name, user name, JWT subject or certificate common name
+	Name string
+	// Authentication method: apikey, basic, jwt or cert
+	Method string
+	// JWT claims, nil for other methods
+	Claims map[string]interface{}
+}
+
+// authenticator checks credentials of a request. It returns nil, nil
+// when the request carries no credentials of its kind.
+type authenticator interface {
+	Authenticate(r *http.Request) (*principal, error)
+	// Scheme for WWW-Authenticate header, empty if none
+	Scheme() string
+}
+
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// id identifies p across requests, es. jwt:alice.
+// It is empty when authentication is disabled.
+func (p *principal) id() string {
+	if p == nil {
+		return ""
+	}
+	return p.Method + ":" + p.Name
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx holding p.
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal of the request, nil if
+// authentication is disabled.
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// readCredentialsFile reads name:secret lines, blank lines
+// and lines starting with # are skipped.
+func readCredentialsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	credentials := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:secret", path, n)
+		}
+		credentials[kv[0]] = kv[1]
+	}
+	return credentials, scanner.Err()
+}
+
+// apiKeyAuth authenticates static API keys passed in X-API-Key header.
+type apiKeyAuth struct {
+	// name by key
+	keys map[string]string
+}
+
+// newAPIKeyAuth loads a file of name:key lines.
+func newAPIKeyAuth(path string) (*apiKeyAuth, error) {
+	credentials, err := readCredentialsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &apiKeyAuth{keys: map[string]string{}}
+	for name, key := range credentials {
+		a.keys[key] = name
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuth) Authenticate(r *http.Request) (*principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, nil
+	}
+	// Compare all keys in constant time
+	name := ""
+	for k, v := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			name = v
+		}
+	}
+	if name == "" {
+		return nil, errInvalidCredentials
+	}
+	return &principal{Name: name, Method: "apikey"}, nil
+}
+
+func (a *apiKeyAuth) Scheme() string {
+	return ""
+}
+
+// basicAuth authenticates HTTP Basic credentials
+// against a file of user:bcrypt-hash lines.
+type basicAuth struct {
+	hashes map[string]string
+}
+
+func newBasicAuth(path string) (*basicAuth, error) {
+	hashes, err := readCredentialsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for user, hash := range hashes {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s: invalid bcrypt hash for %s", path, user)
+		}
+	}
+	return &basicAuth{hashes: hashes}, nil
+}
+
+func (a *basicAuth) Authenticate(r *http.Request) (*principal, error) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+		return nil, nil
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	hash, ok := a.hashes[user]
+	if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, errInvalidCredentials
+	}
+	return &principal{Name: user, Method: "basic"}, nil
+}
+
+func (a *basicAuth) Scheme() string {
+	return `Basic realm="morest"`
+}
+
+// certAuth authenticates TLS client certificates verified against
+// the CA configured with -ssl-client-ca, principal is the common name.
+type certAuth struct{}
+
+func (a *certAuth) Authenticate(r *http.Request) (*principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return nil, errInvalidCredentials
+	}
+	return &principal{Name: cn, Method: "cert"}, nil
+}
+
+func (a *certAuth) Scheme() string {
+	return ""
+}
+
+// jwtAuth validates bearer JSON Web Tokens signed
+// with HS256 (shared secret) or RS256 (public key).
+type jwtAuth struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	// Required claims, if not empty
+	audience string
+	issuer   string
+	// Scope the token must grant, 403 otherwise
+	scope string
+	now   func() time.Time
+}
+
+// newJWTAuth loads HS256 secret and RS256 PEM public key files,
+// at least one is required.
+func newJWTAuth(secretPath, publicKeyPath string) (*jwtAuth, error) {
+	a := &jwtAuth{now: time.Now}
+	if secretPath != "" {
+		secret, err := ioutil.ReadFile(secretPath)
+		if err != nil {
+			return nil, err
+		}
+		a.secret = []byte(strings.TrimSpace(string(secret)))
+		if len(a.secret) == 0 {
+			return nil, fmt.Errorf("%s: empty secret", secretPath)
+		}
+	}
+	if publicKeyPath != "" {
+		data, err := ioutil.ReadFile(publicKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		a.publicKey, err = parseRSAPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", publicKeyPath, err)
+		}
+	}
+	if a.secret == nil && a.publicKey == nil {
+		return nil, fmt.Errorf("JWT requires a secret or a public key")
+	}
+	return a, nil
+}
+
+// parseRSAPublicKey decodes a PEM public key or certificate.
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+	return rsaKey, nil
+}
+
+func (a *jwtAuth) Authenticate(r *http.Request) (*principal, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	claims, err := a.verify(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return nil, err
+	}
+	// sub identifies the client to cursors and policy rules
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errInvalidCredentials
+	}
+	if a.scope != "" {
+		scope, _ := claims["scope"].(string)
+		if !containsString(strings.Fields(scope), a.scope) {
+			return nil, &apiError{
+				Status:  http.StatusForbidden,
+				Code:    "Forbidden",
+				Message: fmt.Sprintf("Token lacks %s scope", a.scope),
+			}
+		}
+	}
+	return &principal{Name: sub, Method: "jwt", Claims: claims}, nil
+}
+
+func (a *jwtAuth) Scheme() string {
+	return `Bearer realm="morest"`
+}
+
+// verify checks signature and registered claims of token.
+// The algorithm is chosen by the configured keys, so that
+// tokens cannot pick a weaker one (es. none).
+func (a *jwtAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidCredentials
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && a.secret != nil:
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errInvalidCredentials
+		}
+	case header.Alg == "RS256" && a.publicKey != nil:
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errInvalidCredentials
+		}
+	default:
+		return nil, errInvalidCredentials
+	}
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidCredentials
+	}
+	now := float64(a.now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, errInvalidCredentials
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errInvalidCredentials
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, errInvalidCredentials
+	}
+	if a.audience != "" {
+		var audiences []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []interface{}:
+			for _, v := range aud {
+				if s, ok := v.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		if !containsString(audiences, a.audience) {
+			return nil, errInvalidCredentials
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAuth wraps next so that it is called only for requests
+// authenticated by one of auths, the principal is stored in the
+// request context. Others get 401 status code.
+func RequireAuth(next http.HandlerFunc, auths []authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range auths {
+			p, err := a.Authenticate(r)
+			if err != nil {
+				writeAuthError(w, err, auths)
+				return
+			}
+			if p != nil {
+				next(w, r.WithContext(withPrincipal(r.Context(), p)))
+				return
+			}
+		}
+		writeAuthError(w, fmt.Errorf("Authentication required"), auths)
+	}
+}
+
+// writeAuthError reports an authentication failure, challenging
+// the client with schemes of auths.
+func writeAuthError(w http.ResponseWriter, err error, auths []authenticator) {
+	if _, ok := err.(*apiError); ok {
+		writeError(w, err)
+		return
+	}
+	for _, a := range auths {
+		if scheme := a.Scheme(); scheme != "" {
+			w.Header().Add("WWW-Authenticate", scheme)
+		}
+	}
+	writeError(w, &apiError{Status: http.StatusUnauthorized, Code: "Unauthenticated", Message: err.Error()})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("s3cr3t")
+
+func signHS256(header, claims map[string]interface{}, secret []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(claims map[string]interface{}, key *rsa.PrivateKey) string {
+	h, _ := json.Marshal(map[string]interface{}{"alg": "RS256", "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+type authCase struct {
+	Name   string
+	Header http.Header
+	// Expected status code and principal, if authenticated
+	Status int
+	User   string
+}
+
+func TestRequireAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	now := time.Unix(1500000000, 0)
+	jwt := &jwtAuth{
+		secret:    testSecret,
+		publicKey: &rsaKey.PublicKey,
+		audience:  "morest",
+		scope:     "db",
+		now:       func() time.Time { return now },
+	}
+	auths := []authenticator{
+		&apiKeyAuth{keys: map[string]string{"k3y": "device"}},
+		&basicAuth{hashes: map[string]string{"alice": string(hash)}},
+		jwt,
+	}
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "bob", "aud": "morest", "scope": "read db", "exp": now.Unix() + 60}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	basic := func(user, password string) http.Header {
+		r := &http.Request{Header: http.Header{}}
+		r.SetBasicAuth(user, password)
+		return r.Header
+	}
+	cases := []authCase{
+		{"none", http.Header{}, 401, ""},
+		{"api key", http.Header{"X-Api-Key": {"k3y"}}, 200, "apikey:device"},
+		{"wrong api key", http.Header{"X-Api-Key": {"k3"}}, 401, ""},
+		{"basic", basic("alice", "pass"), 200, "basic:alice"},
+		{"wrong password", basic("alice", "wrong"), 401, ""},
+		{"unknown user", basic("eve", "pass"), 401, ""},
+		{"hs256", bearer(signHS256(hs, claims(nil), testSecret)), 200, "jwt:bob"},
+		{"rs256", bearer(signRS256(claims(nil), rsaKey)), 200, "jwt:bob"},
+		{"wrong secret", bearer(signHS256(hs, claims(nil), []byte("guess"))), 401, ""},
+		{"alg none", bearer(signHS256(map[string]interface{}{"alg": "none"}, claims(nil), testSecret)), 401, ""},
+		{"expired", bearer(signHS256(hs, claims(map[string]interface{}{"exp": now.Unix()}), testSecret)), 401, ""},
+		{"not before", bearer(signHS256(hs, claims(map[string]interface{}{"nbf": now.Unix() + 10}), testSecret)), 401, ""},
+		{"audience list", bearer(signHS256(hs, claims(map[string]interface{}{"aud": []string{"x", "morest"}}), testSecret)), 200, "jwt:bob"},
+		{"wrong audience", bearer(signHS256(hs, claims(map[string]interface{}{"aud": "other"}), testSecret)), 401, ""},
+		{"missing scope", bearer(signHS256(hs, claims(map[string]interface{}{"scope": "read"}), testSecret)), 403, ""},
+		{"malformed", bearer("a.b"), 401, ""},
+		{"no subject", bearer(signHS256(hs, claims(map[string]interface{}{"sub": nil}), testSecret)), 401, ""},
+		{"empty subject", bearer(signHS256(hs, claims(map[string]interface{}{"sub": ""}), testSecret)), 401, ""},
+		{"numeric subject", bearer(signHS256(hs, claims(map[string]interface{}{"sub": 42}), testSecret)), 401, ""},
+	}
+	for _, singleCase := range cases {
+		var user string
+		handler := RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+			user = principalFrom(r.Context()).id()
+		}, auths)
+		r := httptest.NewRequest("GET", "/db/coll.find()", nil)
+		r.Header = singleCase.Header
+		w := httptest.NewRecorder()
+		handler(w, r)
+		challenged := w.Header().Get("WWW-Authenticate") != ""
+		if w.Code != singleCase.Status || user != singleCase.User || challenged != (w.Code == 401) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s\n", singleCase.Name)
+				fmt.Printf("got: %d %q %s\n", w.Code, user, w.Body.String())
+			}
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server side cursors: find and aggregate called with cursor url
+// parameter return only the first batch of documents, the others
+// are fetched with getMore requests on /_cursors/<id>.
+// Cursors are kept alive, together with their session, in a bounded
+// registry and are closed when exhausted, killed or idle for too long.
+
+// Size of first batch when not specified, as in mongodb.
+const defaultBatchSize = 101
+
+var errTooManyCursors = errors.New("Too many open cursors")
+var errCursorNotFound = errors.New("Cursor not found")
+
+// cursors is the registry used by handlers, configured in main.
+var cursors = newCursorRegistry(100, 10*time.Minute)
+
+// liveCursor is a cursor kept open between requests.
+type liveCursor struct {
+	// Serializes getMore on the same cursor.
+	sync.Mutex
+	ID        string
+	Namespace string
+	BatchSize int
+	Canonical bool
+	// Principal that opened the cursor, see principal.id
+	Owner string
+	// Fields redacted or masked in batches
+	fields  *fieldRules
+	iter    *mgo.Iter
+	session *mgo.Session
+	// Guarded by registry lock.
+	expires time.Time
+}
+
+// nextBatch reads up to n documents, done is true when cursor is exhausted.
+func (c *liveCursor) nextBatch(n int) (batch []interface{}, done bool, err error) {
+	batch = []interface{}{}
+	if c.iter == nil {
+		return batch, true, nil
+	}
+	for len(batch) < n {
+		doc := bson.M{}
+		if !c.iter.Next(&doc) {
+			return batch, true, c.iter.Close()
+		}
+		c.fields.apply(doc)
+		batch = append(batch, doc)
+	}
+	return batch, false, nil
+}
+
+// close releases server cursor and session, it is safe to call it twice.
+func (c *liveCursor) close() {
+	if c.iter != nil {
+		c.iter.Close()
+		c.iter = nil
+	}
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+}
+
+// response renders a batch like mongodb does, id is "0"
+// when there are no more documents.
+func (c *liveCursor) response(field string, batch []interface{}, done bool) ([]byte, error) {
+	id := c.ID
+	if done {
+		id = "0"
+	}
+	return marshalExtJSON(bson.D{{Name: "cursor", Value: bson.D{
+		{Name: "id", Value: id},
+		{Name: "ns", Value: c.Namespace},
+		{Name: field, Value: batch},
+	}}}, c.Canonical)
+}
+
+// cursorRegistry holds open cursors by ID.
+type cursorRegistry struct {
+	sync.Mutex
+	cursors map[string]*liveCursor
+	// Maximum number of open cursors
+	max int
+	// Cursors not used for this long are closed
+	ttl time.Duration
+}
+
+func newCursorRegistry(max int, ttl time.Duration) *cursorRegistry {
+	return &cursorRegistry{cursors: map[string]*liveCursor{}, max: max, ttl: ttl}
+}
+
+// add registers c giving it a new random ID.
+func (r *cursorRegistry) add(c *liveCursor) error {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(r.cursors) >= r.max {
+		return errTooManyCursors
+	}
+	c.ID = hex.EncodeToString(b)
+	c.expires = time.Now().Add(r.ttl)
+	r.cursors[c.ID] = c
+	return nil
+}
+
+// get returns the cursor with id postponing its expiration.
+func (r *cursorRegistry) get(id string) (*liveCursor, error) {
+	r.Lock()
+	defer r.Unlock()
+	c, ok := r.cursors[id]
+	if !ok {
+		return nil, errCursorNotFound
+	}
+	c.expires = time.Now().Add(r.ttl)
+	return c, nil
+}
+
+// remove unregisters and closes the cursor with id.
+func (r *cursorRegistry) remove(id string) error {
+	r.Lock()
+	c, ok := r.cursors[id]
+	delete(r.cursors, id)
+	r.Unlock()
+	if !ok {
+		return errCursorNotFound
+	}
+	c.Lock()
+	c.close()
+	c.Unlock()
+	return nil
+}
+
+// expire closes cursors idle for more than ttl.
+func (r *cursorRegistry) expire(now time.Time) {
+	expired := []string{}
+	r.Lock()
+	for id, c := range r.cursors {
+		if now.After(c.expires) {
+			expired = append(expired, id)
+		}
+	}
+	r.Unlock()
+	for _, id := range expired {
+		if DEBUG {
+			log.Printf("[DEBUG] closing idle cursor %s\n", id)
+		}
+		r.remove(id)
+	}
+}
+
+// expireLoop runs expire every interval, it never returns.
+func (r *cursorRegistry) expireLoop(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		r.expire(now)
+	}
+}
+
+// batchSize returns the size of batches of a cursor request.
+func (s *mongoRequest) batchSize() int {
+	var n int64
+	if sub, ok := s.subAction("batchSize"); ok {
+		n, _ = strconv.ParseInt(strings.TrimSpace(sub.Args), 10, 64)
+	} else if s.Action == "aggregate" {
+		n, _ = toInt64(s.Args1["batchSize"])
+	}
+	if n <= 0 {
+		return defaultBatchSize
+	}
+	return int(n)
+}
+
+// checkCursor validates a request for a server side cursor.
+func checkCursor(s *mongoRequest) error {
+	if !(s.Action == "find" || s.Action == "aggregate") {
+		return fmt.Errorf("Cursor is supported only by find and aggregate")
+	}
+	if _, ok := s.subAction("count"); ok {
+		return fmt.Errorf("count cannot return a cursor")
+	}
+	if s.Paginate {
+		return fmt.Errorf("Cursor cannot be used with pagination")
+	}
+	return nil
+}
+
+// openCursor returns the first batch of iter, if there are more
+// documents the cursor is registered taking ownership of the request session.
+func openCursor(iter *mgo.Iter, s *mongoRequest) ([]byte, error) {
+	c := &liveCursor{
+		Namespace: s.Database + "." + s.Collection,
+		BatchSize: s.batchSize(),
+		Canonical: s.Canonical,
+		Owner:     s.client.id(),
+		fields:    s.fields,
+		iter:      iter,
+		session:   s.session,
+	}
+	s.session = nil
+	batch, done, err := c.nextBatch(c.BatchSize)
+	if err != nil || done {
+		c.close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		if err := cursors.add(c); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c.response("firstBatch", batch, done)
+}
+
+// ownedCursor returns cursor id if it was opened by owner,
+// cursors of other principals are reported as not found.
+func ownedCursor(id, owner string) (*liveCursor, error) {
+	c, err := cursors.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.Owner != owner {
+		return nil, errCursorNotFound
+	}
+	return c, nil
+}
+
+// getMore returns next batch of cursor id.
+func getMore(id, owner string, params map[string][]string) ([]byte, error) {
+	c, err := ownedCursor(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	n := c.BatchSize
+	if v, ok := params["batchSize"]; ok {
+		n, err = strconv.Atoi(v[0])
+		if err != nil || n <= 0 {
+			return nil, badRequest(fmt.Errorf("batchSize must be a positive integer"))
+		}
+	}
+	c.Lock()
+	batch, done, err := c.nextBatch(n)
+	c.Unlock()
+	if err != nil || done {
+		cursors.remove(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.response("nextBatch", batch, done)
+}
+
+// MakeCursorsHandler serves getMore (GET) and kill (DELETE)
+// requests on /_cursors/<id>.
+func MakeCursorsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/_cursors/")
+		owner := principalFrom(r.Context()).id()
+		var data []byte
+		var err error
+		switch r.Method {
+		case "GET":
+			data, err = getMore(id, owner, r.URL.Query())
+		case "DELETE":
+			if _, err = ownedCursor(id, owner); err == nil {
+				err = cursors.remove(id)
+			}
+			data = []byte(fmt.Sprintf(`{"cursorsKilled":[%q]}`, id))
+		default:
+			err = &apiError{
+				Status:  http.StatusMethodNotAllowed,
+				Code:    "MethodNotAllowed",
+				Message: fmt.Sprintf("Method %s not allowed on cursors", r.Method),
+				Allow:   []string{"GET", "DELETE"},
+			}
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s\n", data)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCursorRegistry(t *testing.T) {
+	registry := newCursorRegistry(2, time.Minute)
+	c1, c2 := &liveCursor{}, &liveCursor{}
+	if registry.add(c1) != nil || registry.add(c2) != nil || c1.ID == c2.ID || len(c1.ID) != 24 {
+		t.Fatal("Unable to add cursors")
+	}
+	if err := registry.add(&liveCursor{}); err != errTooManyCursors {
+		if testing.Verbose() {
+			fmt.Printf("expected %v, got: %v\n", errTooManyCursors, err)
+		}
+		t.Fail()
+	}
+	if c, err := registry.get(c1.ID); err != nil || c != c1 {
+		t.Fail()
+	}
+	if err := registry.remove(c1.ID); err != nil {
+		t.Fail()
+	}
+	if _, err := registry.get(c1.ID); err != errCursorNotFound {
+		t.Fail()
+	}
+	if err := registry.remove(c1.ID); err != errCursorNotFound {
+		t.Fail()
+	}
+	// c2 was not used for ttl
+	registry.expire(time.Now().Add(30 * time.Second))
+	if _, err := registry.get(c2.ID); err != nil {
+		t.Fail()
+	}
+	registry.expire(time.Now().Add(2 * time.Minute))
+	if _, err := registry.get(c2.ID); err != errCursorNotFound {
+		t.Fail()
+	}
+	if batch, done, err := c2.nextBatch(10); len(batch) != 0 || !done || err != nil {
+		t.Fail()
+	}
+}
+
+type checkCursorCase struct {
+	Req *mongoRequest
+	// Expected size of batches
+	BatchSize int
+	// Expect an error for this request
+	Invalid bool
+}
+
+func TestCheckCursor(t *testing.T) {
+	cases := []checkCursorCase{
+		{&mongoRequest{Action: "find"}, defaultBatchSize, false},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"batchSize", "5"}}}, 5, false},
+		{&mongoRequest{Action: "aggregate", Args1: map[string]interface{}{"batchSize": 7}}, 7, false},
+		{&mongoRequest{Action: "findOne"}, defaultBatchSize, true},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"count", ""}}}, defaultBatchSize, true},
+		{&mongoRequest{Action: "find", Paginate: true}, defaultBatchSize, true},
+	}
+	for i, singleCase := range cases {
+		err := checkCursor(singleCase.Req)
+		if (err != nil) != singleCase.Invalid || singleCase.Req.batchSize() != singleCase.BatchSize {
+			if testing.Verbose() {
+				fmt.Printf("case %d: %+v\n", i+1, singleCase.Req)
+				fmt.Printf("got: %d %v\n", singleCase.Req.batchSize(), err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type cursorsHandlerCase struct {
+	Method string
+	ID     string
+	Status int
+	// Client of the request, nil when authentication is disabled
+	Client *principal
+}
+
+func TestCursorsHandler(t *testing.T) {
+	handler := MakeCursorsHandler()
+	c := &liveCursor{}
+	cursors.add(c)
+	device := &principal{Name: "device", Method: "apikey"}
+	owned := &liveCursor{Owner: device.id()}
+	cursors.add(owned)
+	cases := []cursorsHandlerCase{
+		{"GET", "unknown", http.StatusNotFound, nil},
+		{"DELETE", "unknown", http.StatusNotFound, nil},
+		{"POST", c.ID, http.StatusMethodNotAllowed, nil},
+		{"DELETE", c.ID, http.StatusOK, nil},
+		{"GET", c.ID, http.StatusNotFound, nil},
+		{"DELETE", owned.ID, http.StatusNotFound, nil},
+		{"DELETE", owned.ID, http.StatusNotFound, &principal{Name: "other", Method: "apikey"}},
+		{"DELETE", owned.ID, http.StatusOK, device},
+	}
+	for _, singleCase := range cases {
+		recorder := httptest.NewRecorder()
+		req := &http.Request{Method: singleCase.Method, URL: &url.URL{Path: "/_cursors/" + singleCase.ID}}
+		req = req.WithContext(withPrincipal(req.Context(), singleCase.Client))
+		handler(recorder, req)
+		if recorder.Code != singleCase.Status {
+			if testing.Verbose() {
+				fmt.Printf("%s %s expected %d, got: %d\n", singleCase.Method, singleCase.ID, singleCase.Status, recorder.Code)
+			}
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// apiError is an error reported to clients with its status code
+// and a JSON body like:
+// {"code":"SyntaxError","message":"...","offset":12}
+// Code tells the kind of error, so clients can decide whether
+// to retry (Unavailable, Timeout) or not.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Offset in the query of a syntax error
+	Offset *int `json:"offset,omitempty"`
+	// Limit that rejected the query, see limits.go
+	Rule string `json:"rule,omitempty"`
+	// Methods allowed for the action, reported in Allow header
+	Allow []string `json:"-"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// badRequest marks err as caused by an invalid client request.
+func badRequest(err error) error {
+	switch e := err.(type) {
+	case *apiError:
+		return e
+	case *syntaxError:
+		offset := e.Offset
+		return &apiError{Status: http.StatusBadRequest, Code: "SyntaxError", Message: e.Error(), Offset: &offset}
+	}
+	return &apiError{Status: http.StatusBadRequest, Code: "BadRequest", Message: err.Error()}
+}
+
+// methodNotAllowed reports an http method not coherent with the action.
+func methodNotAllowed(action string, allow []string) error {
+	return &apiError{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    "MethodNotAllowed",
+		Message: fmt.Sprintf("Action %s not coherent with http method, use %s", action, strings.Join(allow, " or ")),
+		Allow:   allow,
+	}
+}
+
+// Mongodb error codes.
+const (
+	codeBadValue              = 2
+	codeFailedToParse         = 9
+	codeTypeMismatch          = 14
+	codeInvalidOptions        = 72
+	codeUnrecognizedStage     = 40324
+	codeUnauthorized          = 13
+	codeMaxTimeMSExpired      = 50
+	codeShutdownInProgress    = 91
+	codeNotMaster             = 10107
+	codeInterruptedAtShutdown = 11600
+	codeNotMasterNoSlaveOk    = 13435
+)
+
+// serverErrorCode returns the code of an error returned by mongodb.
+func serverErrorCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		return e.Code, true
+	case *mgo.LastError:
+		return e.Code, true
+	case *mgo.BulkError:
+		if cases := e.Cases(); len(cases) > 0 {
+			return serverErrorCode(cases[0].Err)
+		}
+	}
+	return 0, false
+}
+
+// toAPIError classifies err, errors not recognized are internal errors.
+func toAPIError(err error) *apiError {
+	if e, ok := err.(*apiError); ok {
+		return e
+	}
+	e := &apiError{Status: http.StatusInternalServerError, Code: "InternalError", Message: err.Error()}
+	code, isServerError := serverErrorCode(err)
+	netErr, isNetError := err.(net.Error)
+	switch {
+	case err == mgo.ErrNotFound || err == errCursorNotFound:
+		e.Status, e.Code, e.Message = http.StatusNotFound, "NotFound", "not found"
+	case mgo.IsDup(err):
+		e.Status, e.Code = http.StatusConflict, "DuplicateKey"
+	case err == errTooManyCursors:
+		e.Status, e.Code = http.StatusServiceUnavailable, "TooManyCursors"
+	case isNetError && netErr.Timeout():
+		e.Status, e.Code = http.StatusGatewayTimeout, "Timeout"
+	case isServerError && code == codeMaxTimeMSExpired:
+		e.Status, e.Code = http.StatusGatewayTimeout, "Timeout"
+	case isServerError && (code == codeBadValue || code == codeFailedToParse || code == codeTypeMismatch ||
+		code == codeInvalidOptions || code == codeUnrecognizedStage):
+		// Query rejected by mongodb validation
+		e.Status, e.Code = http.StatusBadRequest, "BadRequest"
+	case isServerError && code == codeUnauthorized:
+		e.Status, e.Code = http.StatusForbidden, "Unauthorized"
+	case isServerError && (code == codeNotMaster || code == codeNotMasterNoSlaveOk ||
+		code == codeShutdownInProgress || code == codeInterruptedAtShutdown):
+		e.Status, e.Code = http.StatusServiceUnavailable, "Unavailable"
+	case isNetError, err == io.EOF, err.Error() == "no reachable servers":
+		e.Status, e.Code = http.StatusServiceUnavailable, "Unavailable"
+	}
+	if lastErr, ok := err.(*mgo.LastError); ok && lastErr.WTimeout {
+		e.Status, e.Code = http.StatusGatewayTimeout, "Timeout"
+	}
+	return e
+}
+
+// writeError reports err to the client with the matching status code.
+func writeError(w http.ResponseWriter, err error) {
+	e := toAPIError(err)
+	if e.Status == http.StatusInternalServerError {
+		log.Printf("[ERROR] %v\n", err)
+	}
+	if len(e.Allow) > 0 {
+		w.Header().Set("Allow", strings.Join(e.Allow, ", "))
+	}
+	body, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	fmt.Fprintf(w, "%s\n", body)
+}
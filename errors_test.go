@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// timeoutError mimics a network timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type toAPIErrorCase struct {
+	Err    error
+	Status int
+	Code   string
+}
+
+func TestToAPIError(t *testing.T) {
+	cases := []toAPIErrorCase{
+		{badRequest(&syntaxError{Offset: 7, Msg: "unterminated document"}), http.StatusBadRequest, "SyntaxError"},
+		{badRequest(errors.New("Invalid sort")), http.StatusBadRequest, "BadRequest"},
+		{methodNotAllowed("insert", []string{"POST"}), http.StatusMethodNotAllowed, "MethodNotAllowed"},
+		{mgo.ErrNotFound, http.StatusNotFound, "NotFound"},
+		{errCursorNotFound, http.StatusNotFound, "NotFound"},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}, http.StatusConflict, "DuplicateKey"},
+		{&mgo.QueryError{Code: 50, Message: "operation exceeded time limit"}, http.StatusGatewayTimeout, "Timeout"},
+		{&mgo.LastError{Code: 64, Err: "waiting for replication timed out", WTimeout: true}, http.StatusGatewayTimeout, "Timeout"},
+		{&mgo.QueryError{Code: 2, Message: "unknown operator: $foo"}, http.StatusBadRequest, "BadRequest"},
+		{&mgo.QueryError{Code: 9, Message: "Failed to parse"}, http.StatusBadRequest, "BadRequest"},
+		{&mgo.QueryError{Code: 14, Message: "$size needs a number"}, http.StatusBadRequest, "BadRequest"},
+		{&mgo.QueryError{Code: 72, Message: "invalid options"}, http.StatusBadRequest, "BadRequest"},
+		{&mgo.QueryError{Code: 40324, Message: "Unrecognized pipeline stage name: '$foo'"}, http.StatusBadRequest, "BadRequest"},
+		{&mgo.LastError{Code: 2, Err: "unknown modifier: $foo"}, http.StatusBadRequest, "BadRequest"},
+		{&mgo.QueryError{Code: 13, Message: "not authorized"}, http.StatusForbidden, "Unauthorized"},
+		{&mgo.QueryError{Code: 10107, Message: "not master"}, http.StatusServiceUnavailable, "Unavailable"},
+		{errors.New("no reachable servers"), http.StatusServiceUnavailable, "Unavailable"},
+		{io.EOF, http.StatusServiceUnavailable, "Unavailable"},
+		{timeoutError{}, http.StatusGatewayTimeout, "Timeout"},
+		{errTooManyCursors, http.StatusServiceUnavailable, "TooManyCursors"},
+		{errors.New("boom"), http.StatusInternalServerError, "InternalError"},
+	}
+	for _, singleCase := range cases {
+		got := toAPIError(singleCase.Err)
+		if got.Status != singleCase.Status || got.Code != singleCase.Code {
+			if testing.Verbose() {
+				fmt.Printf("error: %v\n", singleCase.Err)
+				fmt.Printf("expected: %d %s, got: %d %s\n", singleCase.Status, singleCase.Code, got.Status, got.Code)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeError(recorder, badRequest(&syntaxError{Offset: 0, Msg: "expected a name"}))
+	body := map[string]interface{}{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if recorder.Code != http.StatusBadRequest || body["code"] != "SyntaxError" || body["offset"] != float64(0) {
+		if testing.Verbose() {
+			fmt.Printf("got: %d %s\n", recorder.Code, recorder.Body.String())
+		}
+		t.Fail()
+	}
+	// A method not coherent with the action
+	s := mongoRequest{}
+	err := s.Decode(&http.Request{Method: "GET", RequestURI: `/db.coll.insert({"a":1})`})
+	recorder = httptest.NewRecorder()
+	writeError(recorder, err)
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "POST" {
+		if testing.Verbose() {
+			fmt.Printf("got: %d %v %s\n", recorder.Code, recorder.Header(), recorder.Body.String())
+		}
+		t.Fail()
+	}
+	recorder = httptest.NewRecorder()
+	writeError(recorder, mgo.ErrNotFound)
+	if recorder.Body.String() != "{\"code\":\"NotFound\",\"message\":\"not found\"}\n" {
+		t.Fail()
+	}
+}
+
+func TestMainHandlerPanic(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	// A nil session panics when the request is executed
+	MakeMainHandler(nil)(recorder, httptest.NewRequest("GET", "/db.coll.find()", nil))
+	body := map[string]interface{}{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if recorder.Code != http.StatusInternalServerError || body["code"] != "InternalError" {
+		if testing.Verbose() {
+			fmt.Printf("got: %d %s\n", recorder.Code, recorder.Body.String())
+		}
+		t.Fail()
+	}
+}
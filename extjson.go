@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MongoDB Extended JSON v2 support.
+// Parsed documents are converted into bson types (es. {"$oid":"..."}
+// becomes a bson.ObjectId) and query results are rendered back
+// in canonical or relaxed mode.
+// https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+
+// extJSONDateLayout is used for relaxed dates.
+const extJSONDateLayout = "2006-01-02T15:04:05.999Z07:00"
+
+// fromExtJSON converts a parsed document which is an Extended JSON
+// type wrapper into the corresponding bson value.
+// Documents that are not type wrappers are returned as they are.
+func fromExtJSON(doc map[string]interface{}) (interface{}, error) {
+	if len(doc) == 0 || len(doc) > 2 {
+		return doc, nil
+	}
+	if len(doc) == 2 {
+		// Legacy binary format: {"$binary":"<base64>","$type":"<hex>"}
+		b64, ok1 := doc["$binary"].(string)
+		subType, ok2 := doc["$type"].(string)
+		if ok1 && ok2 {
+			return decodeExtBinary(b64, subType)
+		}
+		return doc, nil
+	}
+	for k, v := range doc {
+		switch k {
+		case "$oid":
+			s, ok := v.(string)
+			if !ok || !bson.IsObjectIdHex(s) {
+				return nil, fmt.Errorf("Invalid $oid value")
+			}
+			return bson.ObjectIdHex(s), nil
+		case "$date":
+			return decodeExtDate(v)
+		case "$numberInt":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$numberInt value must be a string")
+			}
+			n, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid $numberInt value")
+			}
+			return int(n), nil
+		case "$numberLong":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$numberLong value must be a string")
+			}
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid $numberLong value")
+			}
+			return n, nil
+		case "$numberDouble":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$numberDouble value must be a string")
+			}
+			switch s {
+			case "Infinity":
+				return math.Inf(1), nil
+			case "-Infinity":
+				return math.Inf(-1), nil
+			case "NaN":
+				return math.NaN(), nil
+			}
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid $numberDouble value")
+			}
+			return f, nil
+		case "$numberDecimal":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$numberDecimal value must be a string")
+			}
+			d, err := bson.ParseDecimal128(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid $numberDecimal value")
+			}
+			return d, nil
+		case "$binary":
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$binary value must be a document")
+			}
+			b64, ok1 := fields["base64"].(string)
+			subType, ok2 := fields["subType"].(string)
+			if !ok1 || !ok2 || len(fields) != 2 {
+				return nil, fmt.Errorf("$binary requires base64 and subType")
+			}
+			return decodeExtBinary(b64, subType)
+		case "$regularExpression":
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$regularExpression value must be a document")
+			}
+			pattern, ok1 := fields["pattern"].(string)
+			options, ok2 := fields["options"].(string)
+			if !ok1 || !ok2 || len(fields) != 2 {
+				return nil, fmt.Errorf("$regularExpression requires pattern and options")
+			}
+			return bson.RegEx{Pattern: pattern, Options: options}, nil
+		case "$timestamp":
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$timestamp value must be a document")
+			}
+			t, ok1 := toInt64(fields["t"])
+			i, ok2 := toInt64(fields["i"])
+			if !ok1 || !ok2 || len(fields) != 2 {
+				return nil, fmt.Errorf("$timestamp requires t and i")
+			}
+			return bson.MongoTimestamp(t<<32 | i), nil
+		case "$symbol":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$symbol value must be a string")
+			}
+			return bson.Symbol(s), nil
+		case "$code":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$code value must be a string")
+			}
+			return bson.JavaScript{Code: s}, nil
+		case "$minKey":
+			return bson.MinKey, nil
+		case "$maxKey":
+			return bson.MaxKey, nil
+		case "$undefined":
+			return bson.Undefined, nil
+		}
+	}
+	return doc, nil
+}
+
+// decodeExtDate decodes $date in relaxed (ISO-8601 string),
+// canonical ($numberLong, already converted) or legacy (number) format.
+func decodeExtDate(v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999Z0700", "2006-01-02T15:04:05.999", "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("Invalid $date value %s", s)
+	}
+	if ms, ok := toInt64(v); ok {
+		return time.Unix(ms/1000, ms%1000*1e6).UTC(), nil
+	}
+	return nil, fmt.Errorf("Invalid $date value")
+}
+
+func decodeExtBinary(b64, subType string) (interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid $binary base64 value")
+	}
+	if len(subType) == 1 {
+		subType = "0" + subType
+	}
+	kind, err := hex.DecodeString(subType)
+	if err != nil || len(kind) != 1 {
+		return nil, fmt.Errorf("Invalid $binary subType value")
+	}
+	return bson.Binary{Kind: kind[0], Data: data}, nil
+}
+
+// toInt64 converts integer numbers decoded from queries.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// toFloat64 converts numbers decoded from queries.
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// marshalExtJSON renders v as Extended JSON in canonical or relaxed mode.
+func marshalExtJSON(v interface{}, canonical bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := writeExtJSON(buf, v, canonical); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeExtJSON(buf *bytes.Buffer, v interface{}, canonical bool) error {
+	switch vv := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool, string:
+		data, err := json.Marshal(vv)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	case int:
+		if vv < math.MinInt32 || vv > math.MaxInt32 {
+			return writeExtJSON(buf, int64(vv), canonical)
+		}
+		writeExtNumber(buf, "$numberInt", strconv.Itoa(vv), canonical)
+	case int32:
+		writeExtNumber(buf, "$numberInt", strconv.Itoa(int(vv)), canonical)
+	case int64:
+		writeExtNumber(buf, "$numberLong", strconv.FormatInt(vv, 10), canonical)
+	case float64:
+		writeExtDouble(buf, vv, canonical)
+	case bson.ObjectId:
+		fmt.Fprintf(buf, `{"$oid":"%s"}`, vv.Hex())
+	case time.Time:
+		ms := vv.Unix()*1000 + int64(vv.Nanosecond()/1e6)
+		if !canonical && vv.Year() >= 1970 && vv.Year() <= 9999 {
+			fmt.Fprintf(buf, `{"$date":"%s"}`, vv.UTC().Format(extJSONDateLayout))
+		} else {
+			fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, ms)
+		}
+	case bson.Binary:
+		fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(vv.Data), vv.Kind)
+	case []byte:
+		fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"00"}}`, base64.StdEncoding.EncodeToString(vv))
+	case bson.RegEx:
+		pattern, _ := json.Marshal(vv.Pattern)
+		options, _ := json.Marshal(vv.Options)
+		fmt.Fprintf(buf, `{"$regularExpression":{"pattern":%s,"options":%s}}`, pattern, options)
+	case bson.MongoTimestamp:
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, uint64(vv)>>32, uint32(vv))
+	case bson.Decimal128:
+		fmt.Fprintf(buf, `{"$numberDecimal":"%s"}`, vv.String())
+	case bson.Symbol:
+		data, _ := json.Marshal(string(vv))
+		fmt.Fprintf(buf, `{"$symbol":%s}`, data)
+	case bson.JavaScript:
+		code, _ := json.Marshal(vv.Code)
+		if vv.Scope == nil {
+			fmt.Fprintf(buf, `{"$code":%s}`, code)
+			return nil
+		}
+		fmt.Fprintf(buf, `{"$code":%s,"$scope":`, code)
+		if err := writeExtJSON(buf, vv.Scope, canonical); err != nil {
+			return err
+		}
+		buf.WriteString("}")
+	case bson.M:
+		return writeExtJSONMap(buf, vv, canonical)
+	case map[string]interface{}:
+		return writeExtJSONMap(buf, vv, canonical)
+	case bson.D:
+		buf.WriteString("{")
+		for i, elem := range vv {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			key, _ := json.Marshal(elem.Name)
+			buf.Write(key)
+			buf.WriteString(":")
+			if err := writeExtJSON(buf, elem.Value, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	case []interface{}:
+		buf.WriteString("[")
+		for i, elem := range vv {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			if err := writeExtJSON(buf, elem, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("]")
+	default:
+		switch v {
+		case bson.MinKey:
+			buf.WriteString(`{"$minKey":1}`)
+			return nil
+		case bson.MaxKey:
+			buf.WriteString(`{"$maxKey":1}`)
+			return nil
+		case bson.Undefined:
+			buf.WriteString(`{"$undefined":true}`)
+			return nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// writeExtJSONMap writes documents with sorted keys, as json.Marshal does.
+func writeExtJSONMap(buf *bytes.Buffer, m map[string]interface{}, canonical bool) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	doc := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		doc = append(doc, bson.DocElem{Name: k, Value: m[k]})
+	}
+	return writeExtJSON(buf, doc, canonical)
+}
+
+func writeExtNumber(buf *bytes.Buffer, wrapper, n string, canonical bool) {
+	if canonical {
+		fmt.Fprintf(buf, `{"%s":"%s"}`, wrapper, n)
+	} else {
+		buf.WriteString(n)
+	}
+}
+
+func writeExtDouble(buf *bytes.Buffer, f float64, canonical bool) {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	case math.IsNaN(f):
+		s = "NaN"
+	default:
+		// Keep a decimal point so that type is preserved
+		s = strconv.FormatFloat(f, 'G', -1, 64)
+		if !strings.ContainsAny(s, ".E") {
+			s += ".0"
+		}
+		if !canonical {
+			buf.WriteString(s)
+			return
+		}
+	}
+	fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, s)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type extJSONCase struct {
+	Case     string
+	Expected interface{}
+}
+
+func TestFromExtJSON(t *testing.T) {
+	decimal, _ := bson.ParseDecimal128("1.5")
+	cases := []extJSONCase{
+		{`{"$oid":"5f1e2d3c4b5a697887766554"}`, bson.ObjectIdHex("5f1e2d3c4b5a697887766554")},
+		{`{"$date":"2014-01-01T10:00:00.5Z"}`, time.Date(2014, 1, 1, 10, 0, 0, 5e8, time.UTC)},
+		{`{"$date":{"$numberLong":"1388534400000"}}`, time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{`{"$numberInt":"42"}`, 42},
+		{`{"$numberLong":"42"}`, int64(42)},
+		{`{"$numberDouble":"42"}`, float64(42)},
+		{`{"$numberDecimal":"1.5"}`, decimal},
+		{`{"$binary":{"base64":"AQI=","subType":"05"}}`, bson.Binary{Kind: 5, Data: []byte{1, 2}}},
+		{`{"$binary":"AQI=","$type":"0"}`, bson.Binary{Kind: 0, Data: []byte{1, 2}}},
+		{`{"$regularExpression":{"pattern":"^a","options":"i"}}`, bson.RegEx{Pattern: "^a", Options: "i"}},
+		{`{"$timestamp":{"t":1,"i":2}}`, bson.MongoTimestamp(1<<32 | 2)},
+		{`{"$maxKey":1}`, bson.MaxKey},
+		{`{"_id":{"$oid":"5f1e2d3c4b5a697887766554"},"n":3000000000}`, map[string]interface{}{
+			"_id": bson.ObjectIdHex("5f1e2d3c4b5a697887766554"),
+			"n":   int64(3000000000),
+		}},
+		{`{"name":{"$regex":"^a","$options":"i"}}`, map[string]interface{}{
+			"name": map[string]interface{}{"$regex": "^a", "$options": "i"},
+		}},
+	}
+	for _, singleCase := range cases {
+		got, err := parseValueString(singleCase.Case)
+		if err != nil || !reflect.DeepEqual(got, singleCase.Expected) {
+			if testing.Verbose() {
+				fmt.Printf("expected: %#v\n", singleCase.Expected)
+				fmt.Printf("got: %#v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+	for _, invalid := range []string{`{"$oid":"xyz"}`, `{"$numberLong":42}`, `{"$date":"yesterday"}`} {
+		if _, err := parseValueString(invalid); err == nil {
+			if testing.Verbose() {
+				fmt.Printf("expected error for: %s\n", invalid)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestMarshalExtJSON(t *testing.T) {
+	doc := bson.D{
+		{Name: "_id", Value: bson.ObjectIdHex("5f1e2d3c4b5a697887766554")},
+		{Name: "when", Value: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "i", Value: 42},
+		{Name: "l", Value: int64(42)},
+		{Name: "d", Value: float64(42)},
+		{Name: "inf", Value: math.Inf(1)},
+		{Name: "tags", Value: []interface{}{"a", bson.M{"b": true}}},
+	}
+	canonical := `{"_id":{"$oid":"5f1e2d3c4b5a697887766554"},` +
+		`"when":{"$date":{"$numberLong":"1388534400000"}},` +
+		`"i":{"$numberInt":"42"},"l":{"$numberLong":"42"},"d":{"$numberDouble":"42.0"},` +
+		`"inf":{"$numberDouble":"Infinity"},"tags":["a",{"b":true}]}`
+	relaxed := `{"_id":{"$oid":"5f1e2d3c4b5a697887766554"},` +
+		`"when":{"$date":"2014-01-01T00:00:00Z"},` +
+		`"i":42,"l":42,"d":42.0,` +
+		`"inf":{"$numberDouble":"Infinity"},"tags":["a",{"b":true}]}`
+	for mode, expected := range map[bool]string{true: canonical, false: relaxed} {
+		got, err := marshalExtJSON(doc, mode)
+		if err != nil || string(got) != expected {
+			if testing.Verbose() {
+				fmt.Printf("expected: %s\n", expected)
+				fmt.Printf("got: %s %v\n", got, err)
+			}
+			t.Fail()
+		}
+		if !mode {
+			continue
+		}
+		// Canonical mode must be parsed back to the same values
+		back, err := parseOrderedValueString(string(got))
+		if err != nil || !reflect.DeepEqual(back.(bson.D)[:6], doc[:6]) {
+			if testing.Verbose() {
+				fmt.Printf("round trip of: %s\n", got)
+				fmt.Printf("got: %#v %v\n", back, err)
+			}
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"strings"
+)
+
+// decodeDocuments decodes a request body holding a single document,
+// an array of documents or documents separated by commas (es. {...},{...}).
+// Body is read with a streaming decoder so it doesn't depend on
+// Content-Length, each document is then converted from Extended JSON.
+func decodeDocuments(body io.Reader) ([]interface{}, error) {
+	reader := bufio.NewReader(body)
+	c, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stream io.Reader = reader
+	switch c {
+	case '[':
+	case '{':
+		stream = io.MultiReader(strings.NewReader("["), reader, strings.NewReader("]"))
+	default:
+		return nil, fmt.Errorf("Payload must be a document or an array of documents")
+	}
+	dec := json.NewDecoder(stream)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	docs := []interface{}{}
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("Document %d: %v", i, err)
+		}
+		doc, err := parseValueString(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("Document %d: %v", i, err)
+		}
+		if _, ok := doc.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("Document %d: not a document", i)
+		}
+		docs = append(docs, doc)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Unexpected data after documents")
+	}
+	return docs, nil
+}
+
+// peekNonSpace skips white spaces and returns next byte without consuming it.
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// insertOptions returns the options document of insert. It is the first
+// argument when documents are passed as request body, the second otherwise.
+func insertOptions(s *mongoRequest) map[string]interface{} {
+	if s.JsonPayloadSlice != nil {
+		return s.Args1
+	}
+	return s.Args2
+}
+
+// insertOrdered tells if documents must be inserted in order,
+// stopping at the first error. Default is true as in mongo shell.
+func insertOrdered(s *mongoRequest) (bool, error) {
+	opts := insertOptions(s)
+	for k := range opts {
+		if !(k == "ordered" || k == "writeConcern") {
+			return false, fmt.Errorf("Unsupported insert option %s", k)
+		}
+	}
+	if _, ok := opts["ordered"]; !ok {
+		return true, nil
+	}
+	return boolOption(opts, "ordered")
+}
+
+// writeErrorCode returns the code of an error reported by the server
+// for a single document, false if err is not a write error (es. network).
+func writeErrorCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return e.Code, true
+	case *mgo.QueryError:
+		return e.Code, true
+	}
+	return 0, false
+}
+
+// executeInsert inserts documents passed as request body with
+// a bulk operation, or the single document passed in url.
+// Documents that cannot be inserted (es. duplicate key) are
+// reported in writeErrors with their index.
+func executeInsert(s *mongoRequest, coll *mgo.Collection) ([]byte, error) {
+	if s.JsonPayloadSlice == nil {
+		err := coll.Insert(s.Args1)
+		if err != nil {
+			return []byte{}, err
+		}
+		return s.writeResult(bson.D{{Name: "nInserted", Value: 1}})
+	}
+	ordered, err := insertOrdered(s)
+	if err != nil {
+		return []byte{}, err
+	}
+	bulk := coll.Bulk()
+	if !ordered {
+		bulk.Unordered()
+	}
+	bulk.Insert(s.JsonPayloadSlice...)
+	nInserted := len(s.JsonPayloadSlice)
+	writeErrors := []interface{}{}
+	if _, err := bulk.Run(); err != nil {
+		bulkErr, ok := err.(*mgo.BulkError)
+		if !ok {
+			return []byte{}, err
+		}
+		cases := bulkErr.Cases()
+		for _, c := range cases {
+			code, isWriteError := writeErrorCode(c.Err)
+			if c.Index < 0 || !isWriteError {
+				return []byte{}, err
+			}
+			writeErrors = append(writeErrors, bson.D{
+				{Name: "index", Value: c.Index},
+				{Name: "code", Value: code},
+				{Name: "errmsg", Value: c.Err.Error()},
+			})
+		}
+		// Cases are sorted by index, in order mode nothing
+		// is inserted after the first failure.
+		if ordered {
+			nInserted = cases[0].Index
+		} else {
+			nInserted -= len(cases)
+		}
+	}
+	return s.writeResult(bson.D{
+		{Name: "nInserted", Value: nInserted},
+		{Name: "writeErrors", Value: writeErrors},
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type decodeDocumentsCase struct {
+	Case     string
+	Expected []interface{}
+	// Expect an error for this body
+	Invalid bool
+}
+
+func TestDecodeDocuments(t *testing.T) {
+	nested := map[string]interface{}{"a": map[string]interface{}{"b": 1}, "c": []interface{}{map[string]interface{}{"d": 2}}}
+	cases := []decodeDocumentsCase{
+		{`  `, nil, false},
+		{`{"a":{"b":1},"c":[{"d":2}]}`, []interface{}{nested}, false},
+		{`[{"a":{"b":1},"c":[{"d":2}]}, {"e":"},{"}]`, []interface{}{nested, map[string]interface{}{"e": "},{"}}, false},
+		{`{"a":{"b":1},"c":[{"d":2}]},{"e":3}`, []interface{}{nested, map[string]interface{}{"e": 3}}, false},
+		{`[{"when":{"$date":"2014-01-01T00:00:00Z"}}]`, []interface{}{
+			map[string]interface{}{"when": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}, false},
+		{`[]`, []interface{}{}, false},
+		{`[{"a":1},2]`, nil, true},
+		{`[{"a":1}`, nil, true},
+		{`[{"a":1}] {"b":2}`, nil, true},
+		{`{"a":1} {"b":2}`, nil, true},
+		{`"a"`, nil, true},
+	}
+	for _, singleCase := range cases {
+		got, err := decodeDocuments(strings.NewReader(singleCase.Case))
+		if (err != nil) != singleCase.Invalid || (err == nil && !reflect.DeepEqual(got, singleCase.Expected)) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s\n", singleCase.Case)
+				fmt.Printf("got: %#v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+}
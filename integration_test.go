@@ -6,27 +6,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 type testCase struct {
 	Req *http.Request
+	// Request body, a fresh reader is set for every run
+	Body string
 	// To test Decode method
 	expectedResult *mongoRequest
 	Err            error
 	// To test MakeMainHandler in case of json response
 	ExpectedJson []map[string]interface{}
+	// To test MakeMainHandler in case of json response which is not a document
+	ExpectedRawJson interface{}
 	// To test MakeMainHandler in case of text response
 	ExpectedText string
 }
 
 var testCases []testCase
 
+// Write concern echoed by writes with mgo default safety mode
+var defaultWriteConcern = map[string]interface{}{"w": float64(1), "j": false, "wtimeout": float64(0)}
+
+// request returns a copy of case request with its body.
+func (c testCase) request() *http.Request {
+	req := *c.Req
+	if c.Body != "" {
+		req.Body = ioutil.NopCloser(strings.NewReader(c.Body))
+		req.ContentLength = int64(len(c.Body))
+	}
+	return &req
+}
+
 func buildTestCases() []testCase {
 	cases := []testCase{}
 	singleCase := testCase{}
@@ -53,6 +73,53 @@ func buildTestCases() []testCase {
 	cases = append(cases, singleCase)
 	//================================================
 	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.count({"num":{"$lt":10}})`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = map[string]interface{}{"$lt": 10}
+	singleCase.expectedResult = &mongoRequest{
+		Database: "testing-db", Collection: "testing-collection", Action: "count", Args1: caseArgs1,
+	}
+	singleCase.ExpectedText = "10\n"
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find({"num":{"$lt":10}}).limit(3).count()`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = map[string]interface{}{"$lt": 10}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "find",
+		Args1:      caseArgs1,
+		SubActions: []cursorModifier{{"limit", "3"}, {"count", ""}},
+	}
+	singleCase.ExpectedText = "10\n"
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find({"num":{"$lt":10}}).limit(3).count(true)`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = map[string]interface{}{"$lt": 10}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "find",
+		Args1:      caseArgs1,
+		SubActions: []cursorModifier{{"limit", "3"}, {"count", "true"}},
+	}
+	singleCase.ExpectedText = "3\n"
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
 	singleCase.Req = &http.Request{
 		Method:     "POST",
 		RequestURI: `/testing-db.testing-collection.find({"name":"pippo"}).sort().limit(5)`,
@@ -74,16 +141,16 @@ func buildTestCases() []testCase {
 		RequestURI: `/testing-db.testing-collection.find({"num":{"$gt":4}}).sort().limit(2)`,
 	}
 	caseArgs1 = make(map[string]interface{})
-	caseArgs1["num"] = map[string]interface{}{"$gt": float64(4)}
+	caseArgs1["num"] = map[string]interface{}{"$gt": 4}
 	singleCase.expectedResult = &mongoRequest{
 		Database:   "testing-db",
 		Collection: "testing-collection",
 		Action:     "find",
 		Args1:      caseArgs1,
-		SubAction1: "sort",
-		SubArgs1:   "",
-		SubAction2: "limit",
-		SubArgs2:   "2",
+		SubActions: []cursorModifier{
+			{"sort", ""},
+			{"limit", "2"},
+		},
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
@@ -115,10 +182,10 @@ func buildTestCases() []testCase {
 		Collection: "testing-collection",
 		Action:     "find",
 		Args1:      caseArgs1,
-		SubAction1: "sort",
-		SubArgs1:   "",
-		SubAction2: "limit",
-		SubArgs2:   "2",
+		SubActions: []cursorModifier{
+			{"sort", ""},
+			{"limit", "2"},
+		},
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
@@ -141,10 +208,10 @@ func buildTestCases() []testCase {
 		Collection: "testing-collection",
 		Action:     "find",
 		Args1:      caseArgs1,
-		SubAction1: "limit",
-		SubArgs1:   "2",
-		SubAction2: "sort",
-		SubArgs2:   `{"name":-1}`,
+		SubActions: []cursorModifier{
+			{"limit", "2"},
+			{"sort", `{"name":-1}`},
+		},
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
@@ -157,17 +224,233 @@ func buildTestCases() []testCase {
 	cases = append(cases, singleCase)
 	//================================================
 	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find().sort({"num":-1}).limit(2).batchSize(100).maxTimeMS(500)`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "find",
+		SubActions: []cursorModifier{
+			{"sort", `{"num":-1}`},
+			{"limit", "2"},
+			{"batchSize", "100"},
+			{"maxTimeMS", "500"},
+		},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-99", "num": float64(99)},
+	)
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-98", "num": float64(98)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find().sort({"num":1}).skip(20).limit(2)`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "find",
+		SubActions: []cursorModifier{
+			{"sort", `{"num":1}`},
+			{"skip", "20"},
+			{"limit", "2"},
+		},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-20", "num": float64(20)},
+	)
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-21", "num": float64(21)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find({"num":5},{"_id":0,"name":1})`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = 5
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "find",
+		Args1:      caseArgs1,
+		Args2:      map[string]interface{}{"_id": 0, "name": 1},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-5"},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.findOne({"num":7},{"_id":0})`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = 7
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "findOne",
+		Args1:      caseArgs1,
+		Args2:      map[string]interface{}{"_id": 0},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-7", "num": float64(7)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.findOne({"num":1000})`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = 1000
+	singleCase.expectedResult = &mongoRequest{
+		Database: "testing-db", Collection: "testing-collection", Action: "findOne", Args1: caseArgs1,
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"code": "NotFound", "message": "not found"},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection2.distinct("name",{"num":{"$lt":5}})`,
+	}
+	caseArgs1 = make(map[string]interface{})
+	caseArgs1["num"] = map[string]interface{}{"$lt": 5}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection2",
+		Action:     "distinct",
+		Key:        "name",
+		Args1:      caseArgs1,
+	}
+	singleCase.ExpectedRawJson = []interface{}{"Ford"}
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection2.distinct({"num":1})`,
+	}
+	singleCase.Err = fmt.Errorf("We expect an error")
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection2.aggregate([{"$match":{"name":"Ford"}},{"$group":{"_id":"$name","total":{"$sum":"$num"}}}])`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection2",
+		Action:     "aggregate",
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"total": float64(45)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "POST",
+		RequestURI: `/testing-db.testing-collection2.aggregate({"allowDiskUse":true,"batchSize":10})`,
+	}
+	singleCase.Body = `[{"$match":{"num":{"$gte":8}}},{"$sort":{"num":1}},{"$project":{"_id":0,"num":1}}]`
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection2",
+		Action:     "aggregate",
+		Args1:      map[string]interface{}{"allowDiskUse": true, "batchSize": 10},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"num": float64(8)},
+	)
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"num": float64(9)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find({name:/^Pippo-1/,num:{$lt:NumberLong(12)},},{_id:0}).sort({num:1})`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "find",
+		Args1: map[string]interface{}{
+			"name": bson.RegEx{Pattern: "^Pippo-1"},
+			"num":  map[string]interface{}{"$lt": int64(12)},
+		},
+		Args2:      map[string]interface{}{"_id": 0},
+		SubActions: []cursorModifier{{"sort", "{num:1}"}},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-1", "num": float64(1)},
+	)
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-10", "num": float64(10)},
+	)
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-11", "num": float64(11)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection.find({},{"name":1,"num":0})`,
+	}
+	singleCase.Err = fmt.Errorf("We expect an error")
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: "/testing-db.testing-collection.find().limit(2).limit(3)",
+	}
+	singleCase.Err = fmt.Errorf("We expect an error")
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
 	singleCase.Req = &http.Request{
 		Method:     "POST",
 		RequestURI: `/testing-db.testing-collection.insert({"name":"Pippo-XX","num":42})`,
 	}
 	caseArgs1 = make(map[string]interface{})
 	caseArgs1["name"] = "Pippo-XX"
-	caseArgs1["num"] = float64(42)
+	caseArgs1["num"] = 42
 	singleCase.expectedResult = &mongoRequest{Database: "testing-db", Collection: "testing-collection", Action: "insert", Args1: caseArgs1}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nInserted": float64(1)},
+		map[string]interface{}{"nInserted": float64(1), "writeConcern": defaultWriteConcern},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -183,7 +466,7 @@ func buildTestCases() []testCase {
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nRemoved": float64(1)},
+		map[string]interface{}{"nRemoved": float64(1), "writeConcern": defaultWriteConcern},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -193,13 +476,13 @@ func buildTestCases() []testCase {
 		RequestURI: `/testing-db.testing-collection.remove({"num":{"$lt":5}})`,
 	}
 	caseArgs1 = make(map[string]interface{})
-	caseArgs1["num"] = map[string]interface{}{"$lt": float64(5)}
+	caseArgs1["num"] = map[string]interface{}{"$lt": 5}
 	singleCase.expectedResult = &mongoRequest{
 		Database: "testing-db", Collection: "testing-collection", Action: "remove", Args1: caseArgs1,
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nRemoved": float64(5)},
+		map[string]interface{}{"nRemoved": float64(5), "writeConcern": defaultWriteConcern},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -209,8 +492,8 @@ func buildTestCases() []testCase {
 		RequestURI: `/testing-db.testing-collection.remove({"num":{"$lt":15}},{"justOne":1})`,
 	}
 	caseArgs1 = make(map[string]interface{})
-	caseArgs1["num"] = map[string]interface{}{"$lt": float64(15)}
-	caseArgs2["justOne"] = float64(1)
+	caseArgs1["num"] = map[string]interface{}{"$lt": 15}
+	caseArgs2["justOne"] = 1
 	singleCase.expectedResult = &mongoRequest{
 		Database:   "testing-db",
 		Collection: "testing-collection",
@@ -220,7 +503,7 @@ func buildTestCases() []testCase {
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nRemoved": float64(1)},
+		map[string]interface{}{"nRemoved": float64(1), "writeConcern": defaultWriteConcern},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -242,7 +525,7 @@ func buildTestCases() []testCase {
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nModified": float64(1)},
+		map[string]interface{}{"nModified": float64(1), "writeConcern": defaultWriteConcern},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -256,7 +539,7 @@ func buildTestCases() []testCase {
 	caseArgs3 = make(map[string]interface{})
 	caseArgs1["name"] = "Pluto"
 	caseArgs2["name"] = "Paperino"
-	caseArgs3["upsert"] = float64(1)
+	caseArgs3["upsert"] = 1
 	singleCase.expectedResult = &mongoRequest{
 		Database:   "testing-db",
 		Collection: "testing-collection",
@@ -267,7 +550,7 @@ func buildTestCases() []testCase {
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nUpserted": float64(1)},
+		map[string]interface{}{"nUpserted": float64(1), "writeConcern": defaultWriteConcern},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -280,8 +563,8 @@ func buildTestCases() []testCase {
 	caseArgs2 = make(map[string]interface{})
 	caseArgs3 = make(map[string]interface{})
 	caseArgs1["name"] = "Ford"
-	caseArgs2["$set"] = map[string]interface{}{"answer": float64(42)}
-	caseArgs3["multi"] = float64(1)
+	caseArgs2["$set"] = map[string]interface{}{"answer": 42}
+	caseArgs3["multi"] = 1
 	singleCase.expectedResult = &mongoRequest{
 		Database:   "testing-db",
 		Collection: "testing-collection2",
@@ -292,7 +575,163 @@ func buildTestCases() []testCase {
 	}
 	singleCase.ExpectedJson = append(
 		singleCase.ExpectedJson,
-		map[string]interface{}{"nModified": float64(10)},
+		map[string]interface{}{"nModified": float64(10), "writeConcern": defaultWriteConcern},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "PUT",
+		RequestURI: `/testing-db.testing-collection.findOneAndUpdate({"name":"Pippo-50"},{"$inc":{"num":1}},{"returnNewDocument":true,"projection":{"_id":0}})`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "findOneAndUpdate",
+		Args1:      map[string]interface{}{"name": "Pippo-50"},
+		Args2:      map[string]interface{}{"$inc": map[string]interface{}{"num": 1}},
+		Args3: map[string]interface{}{
+			"returnNewDocument": true,
+			"projection":        map[string]interface{}{"_id": 0},
+		},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-50", "num": float64(51)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "PUT",
+		RequestURI: `/testing-db.testing-collection.findAndModify({"query":{"name":"Pippo-60"},"update":{"$set":{"claimed":true}},"fields":{"_id":0,"name":1}})`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "findAndModify",
+		Args1: map[string]interface{}{
+			"query":  map[string]interface{}{"name": "Pippo-60"},
+			"update": map[string]interface{}{"$set": map[string]interface{}{"claimed": true}},
+			"fields": map[string]interface{}{"_id": 0, "name": 1},
+		},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-60"},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "DELETE",
+		RequestURI: `/testing-db.testing-collection.findOneAndDelete({"num":{"$gte":90}},{"sort":{"num":-1},"projection":{"_id":0}})`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection",
+		Action:     "findOneAndDelete",
+		Args1:      map[string]interface{}{"num": map[string]interface{}{"$gte": 90}},
+		Args2: map[string]interface{}{
+			"sort":       map[string]interface{}{"num": -1},
+			"projection": map[string]interface{}{"_id": 0},
+		},
+		Sort: []string{"-num"},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"name": "Pippo-99", "num": float64(99)},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "PUT",
+		RequestURI: `/testing-db.testing-collection.findAndModify({"query":{"name":"Pippo-60"}})`,
+	}
+	singleCase.Err = fmt.Errorf("We expect an error")
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "POST",
+		RequestURI: `/testing-db.testing-collection3.insert({"_id":{"$oid":"5f1e2d3c4b5a697887766554"},"when":{"$date":"2014-01-01T00:00:00Z"},"n":{"$numberLong":"42"}})`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection3",
+		Action:     "insert",
+		Args1: map[string]interface{}{
+			"_id":  bson.ObjectIdHex("5f1e2d3c4b5a697887766554"),
+			"when": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+			"n":    int64(42),
+		},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"nInserted": float64(1), "writeConcern": defaultWriteConcern},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection3.find({"_id":{"$oid":"5f1e2d3c4b5a697887766554"}},{"_id":0})?extjson=canonical`,
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection3",
+		Action:     "find",
+		Args1:      map[string]interface{}{"_id": bson.ObjectIdHex("5f1e2d3c4b5a697887766554")},
+		Args2:      map[string]interface{}{"_id": 0},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{
+			"when": map[string]interface{}{"$date": map[string]interface{}{"$numberLong": "1388534400000"}},
+			"n":    map[string]interface{}{"$numberLong": "42"},
+		},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "POST",
+		RequestURI: `/testing-db.testing-collection4.insert()`,
+		Header:     http.Header{"Content-Type": {"application/x-ndjson"}},
+	}
+	singleCase.Body = "{\"n\":1,\"sub\":{\"a\":1},\"tags\":[{\"b\":2},{\"c\":3}]}\n\n{\"n\":2}\n"
+	singleCase.expectedResult = &mongoRequest{
+		Database: "testing-db", Collection: "testing-collection4", Action: "insert",
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{"nInserted": float64(2), "writeErrors": []interface{}{}, "writeConcern": defaultWriteConcern},
+	)
+	cases = append(cases, singleCase)
+	//================================================
+	singleCase = testCase{}
+	singleCase.Req = &http.Request{
+		Method:     "GET",
+		RequestURI: `/testing-db.testing-collection4.find({},{"_id":0}).sort({"n":1})`,
+		Header:     http.Header{"Accept": {"application/x-ndjson"}},
+	}
+	singleCase.expectedResult = &mongoRequest{
+		Database:   "testing-db",
+		Collection: "testing-collection4",
+		Action:     "find",
+		Args1:      map[string]interface{}{},
+		Args2:      map[string]interface{}{"_id": 0},
+		SubActions: []cursorModifier{{"sort", `{"n":1}`}},
+	}
+	singleCase.ExpectedJson = append(
+		singleCase.ExpectedJson,
+		map[string]interface{}{
+			"n":    float64(1),
+			"sub":  map[string]interface{}{"a": float64(1)},
+			"tags": []interface{}{map[string]interface{}{"b": float64(2)}, map[string]interface{}{"c": float64(3)}},
+		},
+		map[string]interface{}{"n": float64(2)},
 	)
 	cases = append(cases, singleCase)
 	//================================================
@@ -353,6 +792,26 @@ func compareJsonResponses(r string, expectSlice []map[string]interface{}) bool {
 	return true
 }
 
+// compareNDJSONResponses compares a response with one document per line.
+func compareNDJSONResponses(r string, expectSlice []map[string]interface{}) bool {
+	lines := strings.Split(strings.TrimSuffix(r, "\n"), "\n")
+	if len(lines) != len(expectSlice) {
+		return false
+	}
+	for i, line := range lines {
+		resp := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			fmt.Println("[ERROR] Unmarshalling", err, line)
+			return false
+		}
+		delete(resp, "_id")
+		if !reflect.DeepEqual(resp, expectSlice[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 // This test needs mongodb running @ localhost
 func TestMakeMainHandler(t *testing.T) {
 	defer func() {
@@ -374,14 +833,30 @@ func TestMakeMainHandler(t *testing.T) {
 			continue
 		}
 		recorder := httptest.NewRecorder()
-		handler(recorder, singleCase.Req)
+		handler(recorder, singleCase.request())
 		switch recorder.HeaderMap["Content-Type"][0] {
 		case "application/json":
+			if singleCase.ExpectedRawJson != nil {
+				var got interface{}
+				json.Unmarshal(recorder.Body.Bytes(), &got)
+				if !reflect.DeepEqual(got, singleCase.ExpectedRawJson) {
+					fmt.Println("In case", i+1, singleCase.Req.RequestURI)
+					fmt.Printf("Got: %+v\nExpect: %+v\n", recorder.Body.String(), singleCase.ExpectedRawJson)
+					t.Fail()
+				}
+				continue
+			}
 			if !compareJsonResponses(recorder.Body.String(), singleCase.ExpectedJson) {
 				fmt.Println("In case", i+1, singleCase.Req.RequestURI)
 				fmt.Printf("Got: %+v\nExpect: %+v\n", recorder.Body.String(), singleCase.ExpectedJson)
 				t.Fail()
 			}
+		case "application/x-ndjson":
+			if !compareNDJSONResponses(recorder.Body.String(), singleCase.ExpectedJson) {
+				fmt.Println("In case", i+1, singleCase.Req.RequestURI)
+				fmt.Printf("Got: %+v\nExpect: %+v\n", recorder.Body.String(), singleCase.ExpectedJson)
+				t.Fail()
+			}
 		case "text/plain":
 			if recorder.Body.String() != singleCase.ExpectedText {
 				fmt.Println("In case", i+1, singleCase.Req.RequestURI)
@@ -425,10 +900,183 @@ func compareMapInterfaces(o, p map[string]interface{}) bool {
 	return true
 }
 
+type bulkInsertCase struct {
+	Options   string
+	Body      string
+	Inserted  int
+	ErrIndexs []int
+}
+
+// This test needs mongodb running @ localhost
+func TestBulkInsert(t *testing.T) {
+	msession, err := mgo.Dial("localhost")
+	if err != nil {
+		log.Print("Error connecting to Mongodb ", err)
+		t.FailNow()
+	}
+	defer msession.Close()
+	coll := msession.DB("testing-db").C("testing-collection5")
+	body := `[{"_id":1,"sub":{"a":1}},{"_id":1},{"_id":2,"tags":[{"b":2},{"c":3}]},{"_id":2}]`
+	cases := []bulkInsertCase{
+		{``, body, 1, []int{1}},
+		{`{"ordered":true}`, body, 1, []int{1}},
+		{`{"ordered":false}`, body, 2, []int{1, 3}},
+		{`{"ordered":false}`, `{"_id":3},{"_id":4}`, 2, []int{}},
+	}
+	handler := MakeMainHandler(msession)
+	for i, singleCase := range cases {
+		coll.DropCollection()
+		req := &http.Request{
+			Method:        "POST",
+			RequestURI:    "/testing-db.testing-collection5.insert(" + singleCase.Options + ")",
+			Body:          ioutil.NopCloser(strings.NewReader(singleCase.Body)),
+			ContentLength: -1,
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		var got struct {
+			NInserted   int
+			WriteErrors []struct {
+				Index int
+				Code  int
+			}
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &got)
+		indexs := []int{}
+		for _, writeError := range got.WriteErrors {
+			if writeError.Code != 11000 {
+				t.Fail()
+			}
+			indexs = append(indexs, writeError.Index)
+		}
+		n, _ := coll.Count()
+		if got.NInserted != singleCase.Inserted || n != singleCase.Inserted || !reflect.DeepEqual(indexs, singleCase.ErrIndexs) {
+			fmt.Println("In case", i+1, singleCase.Options)
+			fmt.Printf("Got: %s (%d in collection)\n", recorder.Body.String(), n)
+			t.Fail()
+		}
+	}
+}
+
+// This test needs mongodb running @ localhost
+func TestPagination(t *testing.T) {
+	msession, err := mgo.Dial("localhost")
+	if err != nil {
+		log.Print("Error connecting to Mongodb ", err)
+		t.FailNow()
+	}
+	defer msession.Close()
+	coll := msession.DB("testing-db").C("testing-collection6")
+	coll.DropCollection()
+	// Pairs of documents share the same num
+	for i := 0; i < 10; i++ {
+		coll.Insert(bson.M{"_id": i, "num": i / 2})
+	}
+	handler := MakeMainHandler(msession)
+	uri := `/testing-db.testing-collection6.find({"num":{"$lt":5}}).sort({"num":-1}).limit(3)?paginate=true`
+	got := []float64{}
+	for pages := 0; uri != ""; pages++ {
+		if pages > 4 {
+			t.Fatal("Too many pages")
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, &http.Request{Method: "GET", RequestURI: uri})
+		docs := []map[string]interface{}{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &docs); err != nil {
+			t.Fatal(recorder.Body.String())
+		}
+		for _, doc := range docs {
+			got = append(got, doc["_id"].(float64))
+		}
+		uri = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			uri = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	expected := []float64{8, 9, 6, 7, 4, 5, 2, 3, 0, 1}
+	if !reflect.DeepEqual(got, expected) {
+		fmt.Printf("Got: %v\nExpect: %v\n", got, expected)
+		t.Fail()
+	}
+}
+
+// This test needs mongodb running @ localhost
+func TestServerCursor(t *testing.T) {
+	msession, err := mgo.Dial("localhost")
+	if err != nil {
+		log.Print("Error connecting to Mongodb ", err)
+		t.FailNow()
+	}
+	defer msession.Close()
+	coll := msession.DB("testing-db").C("testing-collection7")
+	coll.DropCollection()
+	for i := 0; i < 10; i++ {
+		coll.Insert(bson.M{"_id": i})
+	}
+	type cursorResponse struct {
+		Cursor struct {
+			ID         string
+			NS         string
+			FirstBatch []map[string]interface{}
+			NextBatch  []map[string]interface{}
+		}
+	}
+	mainHandler := MakeMainHandler(msession)
+	cursorsHandler := MakeCursorsHandler()
+	recorder := httptest.NewRecorder()
+	mainHandler(recorder, &http.Request{
+		Method:     "GET",
+		RequestURI: "/testing-db.testing-collection7.find().sort({_id:1}).batchSize(4)?cursor=true",
+	})
+	resp := cursorResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	if resp.Cursor.NS != "testing-db.testing-collection7" || len(resp.Cursor.FirstBatch) != 4 {
+		t.Fatal(recorder.Body.String())
+	}
+	got := len(resp.Cursor.FirstBatch)
+	for id := resp.Cursor.ID; id != "0"; id = resp.Cursor.ID {
+		recorder = httptest.NewRecorder()
+		cursorsHandler(recorder, httptest.NewRequest("GET", "/_cursors/"+id+"?batchSize=3", nil))
+		resp = cursorResponse{}
+		json.Unmarshal(recorder.Body.Bytes(), &resp)
+		if recorder.Code != http.StatusOK || len(resp.Cursor.NextBatch) > 3 {
+			t.Fatal(recorder.Body.String())
+		}
+		for _, doc := range resp.Cursor.NextBatch {
+			if doc["_id"].(float64) != float64(got) {
+				t.Fail()
+			}
+			got++
+		}
+	}
+	if got != 10 {
+		fmt.Println("Got documents:", got)
+		t.Fail()
+	}
+	// Killed cursors are gone
+	recorder = httptest.NewRecorder()
+	mainHandler(recorder, &http.Request{
+		Method:     "GET",
+		RequestURI: "/testing-db.testing-collection7.find().batchSize(2)?cursor=true",
+	})
+	resp = cursorResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	recorder = httptest.NewRecorder()
+	cursorsHandler(recorder, httptest.NewRequest("DELETE", "/_cursors/"+resp.Cursor.ID, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fail()
+	}
+	recorder = httptest.NewRecorder()
+	cursorsHandler(recorder, httptest.NewRequest("GET", "/_cursors/"+resp.Cursor.ID, nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fail()
+	}
+}
+
 func TestDecode(t *testing.T) {
 	for i, singleCase := range testCases {
 		testStruct := mongoRequest{}
-		err := testStruct.Decode(singleCase.Req)
+		err := testStruct.Decode(singleCase.request())
 		if singleCase.Err != nil && err != nil {
 			continue
 		} else if err != nil {
@@ -439,10 +1087,9 @@ func TestDecode(t *testing.T) {
 		} else if !(testStruct.Database == singleCase.expectedResult.Database &&
 			testStruct.Collection == singleCase.expectedResult.Collection &&
 			testStruct.Action == singleCase.expectedResult.Action &&
-			testStruct.SubAction1 == singleCase.expectedResult.SubAction1 &&
-			testStruct.SubArgs1 == singleCase.expectedResult.SubArgs1 &&
-			testStruct.SubAction2 == singleCase.expectedResult.SubAction2 &&
-			testStruct.SubArgs2 == singleCase.expectedResult.SubArgs2 &&
+			testStruct.Key == singleCase.expectedResult.Key &&
+			reflect.DeepEqual(testStruct.SubActions, singleCase.expectedResult.SubActions) &&
+			reflect.DeepEqual(testStruct.Sort, singleCase.expectedResult.Sort) &&
 			reflect.DeepEqual(testStruct.Args1, singleCase.expectedResult.Args1) &&
 			reflect.DeepEqual(testStruct.Args2, singleCase.expectedResult.Args2) &&
 			reflect.DeepEqual(testStruct.Args3, singleCase.expectedResult.Args3)) {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Protection of the cluster from expensive queries. Operators
+// (query, update and aggregation ones, stages included) can be
+// denied or allowed by name and the complexity of queries limited.
+// Rejected requests get 400 with the rule that fired, es.:
+// {"code":"QueryRejected","rule":"maxIn","message":"..."}
+
+// queryLimits are the limits enforced on every request,
+// zero values disable them.
+type queryLimits struct {
+	// Operators rejected, es. $where
+	DenyOperators map[string]bool
+	// If not nil, operators not listed are rejected
+	AllowOperators map[string]bool
+	// Maximum nesting of documents and arrays in arguments,
+	// pipeline and documents passed
+	MaxDepth int
+	// Maximum number of elements of $in and $nin arrays
+	MaxIn int
+	// Maximum value of limit() and $limit stages
+	MaxLimit int
+	// Maximum number of documents returned by find and aggregate,
+	// applied as limit when the query has none
+	MaxDocuments int
+}
+
+// limits used by handlers, configured in main.
+var limits = &queryLimits{}
+
+// parseOperators decodes a comma separated list of operators,
+// the leading $ is optional.
+func parseOperators(list string) map[string]bool {
+	operators := map[string]bool{}
+	for _, op := range strings.Split(list, ",") {
+		op = strings.TrimSpace(op)
+		if op == "" {
+			continue
+		}
+		operators["$"+strings.TrimPrefix(op, "$")] = true
+	}
+	return operators
+}
+
+// queryRejected reports a request violating rule.
+func queryRejected(rule, format string, args ...interface{}) error {
+	return &apiError{
+		Status:  http.StatusBadRequest,
+		Code:    "QueryRejected",
+		Rule:    rule,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// checkOperator rejects op if it is denied or not allowed.
+func (l *queryLimits) checkOperator(op string) error {
+	if l.DenyOperators[op] {
+		return queryRejected("denyOperators", "Operator %s is not allowed", op)
+	}
+	if l.AllowOperators != nil && !l.AllowOperators[op] {
+		return queryRejected("allowOperators", "Operator %s is not in the allowed operators", op)
+	}
+	return nil
+}
+
+// checkValue walks v checking operators, nesting depth and $in size.
+// Regular expressions, es. /^zap/, are checked as $regex operator.
+func (l *queryLimits) checkValue(v interface{}, depth int) error {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		depth++
+		if l.MaxDepth > 0 && depth > l.MaxDepth {
+			return queryRejected("maxDepth", "Nesting deeper than %d levels", l.MaxDepth)
+		}
+		for k, e := range value {
+			if strings.HasPrefix(k, "$") {
+				if err := l.checkOperator(k); err != nil {
+					return err
+				}
+				if array, ok := e.([]interface{}); ok && (k == "$in" || k == "$nin") && l.MaxIn > 0 && len(array) > l.MaxIn {
+					return queryRejected("maxIn", "%s has %d elements, maximum is %d", k, len(array), l.MaxIn)
+				}
+			}
+			if err := l.checkValue(e, depth); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		depth++
+		if l.MaxDepth > 0 && depth > l.MaxDepth {
+			return queryRejected("maxDepth", "Nesting deeper than %d levels", l.MaxDepth)
+		}
+		for _, e := range value {
+			if err := l.checkValue(e, depth); err != nil {
+				return err
+			}
+		}
+	case bson.RegEx:
+		return l.checkOperator("$regex")
+	}
+	return nil
+}
+
+// checkLimit rejects limits greater than MaxLimit and MaxDocuments.
+func (l *queryLimits) checkLimit(n int) error {
+	if n < 0 {
+		// mgo uses negative limits for a single batch
+		n = -n
+	}
+	if l.MaxLimit > 0 && n > l.MaxLimit {
+		return queryRejected("maxLimit", "Limit %d is greater than %d", n, l.MaxLimit)
+	}
+	if l.MaxDocuments > 0 && n > l.MaxDocuments {
+		return queryRejected("maxDocuments", "Limit %d is greater than %d documents", n, l.MaxDocuments)
+	}
+	return nil
+}
+
+// check rejects s if it violates limits, otherwise it caps
+// documents returned by find and aggregate to MaxDocuments.
+func (l *queryLimits) check(s *mongoRequest) error {
+	values := []interface{}{s.Args1, s.Args2, s.Args3, s.Pipeline}
+	if s.JsonPayloadSlice != nil {
+		values = append(values, s.JsonPayloadSlice)
+	}
+
+	for _, v := range values {
+		// Payload and pipeline are arrays, not nesting levels
+		depth := 0
+		if array, ok := v.([]interface{}); ok && array != nil {
+			depth = -1
+		}
+		if err := l.checkValue(v, depth); err != nil {
+			return err
+		}
+	}
+	if s.After != nil {
+		// Operators of keysetCriteria are not chosen by the client,
+		// only nesting of token values is checked. They are matched
+		// at fourth level: {$or: [{field: {$gt: value}}]}
+		depthOnly := &queryLimits{MaxDepth: l.MaxDepth}
+		for _, v := range s.After.Values {
+			if err := depthOnly.checkValue(v, 4); err != nil {
+				return err
+			}
+		}
+	}
+	for _, sub := range s.SubActions {
+		if sub.Action != "limit" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(sub.Args))
+		if err != nil {
+			return fmt.Errorf("Unable to convert limit argument")
+		}
+		if err := l.checkLimit(n); err != nil {
+			return err
+		}
+	}
+	for _, v := range s.Pipeline {
+		stage, _ := v.(map[string]interface{})
+		if n, ok := toInt64(stage["$limit"]); ok {
+			if err := l.checkLimit(int(n)); err != nil {
+				return err
+			}
+		}
+	}
+	if l.MaxDocuments > 0 {
+		l.capDocuments(s)
+	}
+	return nil
+}
+
+// capDocuments applies MaxDocuments as limit of find queries
+// without one, or with limit(0), and as last stage of aggregate
+// pipelines.
+func (l *queryLimits) capDocuments(s *mongoRequest) {
+	switch s.Action {
+	case "find":
+		_, counting := s.subAction("count")
+		if counting {
+			return
+		}
+		for i, sub := range s.SubActions {
+			if sub.Action != "limit" {
+				continue
+			}
+			// limit(0) means no limit
+			if n, _ := strconv.Atoi(strings.TrimSpace(sub.Args)); n == 0 {
+				s.SubActions[i].Args = strconv.Itoa(l.MaxDocuments)
+			}
+			return
+		}
+		s.SubActions = append(s.SubActions, cursorModifier{Action: "limit", Args: strconv.Itoa(l.MaxDocuments)})
+	case "aggregate":
+		if len(s.Pipeline) > 0 {
+			last, _ := s.Pipeline[len(s.Pipeline)-1].(map[string]interface{})
+			// They must be last and return no documents
+			if last["$out"] != nil || last["$merge"] != nil {
+				return
+			}
+		}
+		s.Pipeline = append(s.Pipeline, map[string]interface{}{"$limit": l.MaxDocuments})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type queryLimitsCase struct {
+	Method string
+	Query  string
+	// Rule expected to fire, empty if the query is accepted
+	Rule string
+}
+
+func TestQueryLimits(t *testing.T) {
+	l := &queryLimits{
+		DenyOperators: parseOperators("$where, function,$accumulator,$regex"),
+		MaxDepth:      4,
+		MaxIn:         3,
+		MaxLimit:      100,
+		MaxDocuments:  50,
+	}
+	cases := []queryLimitsCase{
+		{"GET", `/db.coll.find({"a":{"$in":[1,2,3]}}).limit(10)`, ""},
+		{"GET", `/db.coll.find({"$where":"this.a > 1"})`, "denyOperators"},
+		{"GET", `/db.coll.find({"$expr":{"$function":{"body":"f","args":[],"lang":"js"}}})`, "denyOperators"},
+		{"GET", `/db.coll.find({"name":/^zap/i})`, "denyOperators"},
+		{"GET", `/db.coll.aggregate([{"$group":{"_id":null,"x":{"$accumulator":{}}}}])`, "denyOperators"},
+		{"GET", `/db.coll.find({"a":{"$in":[1,2,3,4]}})`, "maxIn"},
+		{"GET", `/db.coll.find({"a":{"$nin":[1,2,3,4]}})`, "maxIn"},
+		{"GET", `/db.coll.find({"a":{"b":{"c":{"d":1}}}})`, ""},
+		{"GET", `/db.coll.find({"a":{"b":{"c":{"d":{"e":1}}}}})`, "maxDepth"},
+		{"GET", `/db.coll.aggregate([{"$match":{"a":{"b":{"c":1}}}}])`, ""},
+		{"GET", `/db.coll.aggregate([{"$match":{"a":{"b":{"c":{"d":1}}}}}])`, "maxDepth"},
+		{"POST", `/db.coll.insert({"a":[[[[1]]]]})`, "maxDepth"},
+		{"GET", `/db.coll.find().limit(101)`, "maxLimit"},
+		{"GET", `/db.coll.find().limit(-101)`, "maxLimit"},
+		{"GET", `/db.coll.find().limit(60)`, "maxDocuments"},
+		{"GET", `/db.coll.find().limit(0)`, ""},
+		{"GET", `/db.coll.aggregate([{"$limit":1000}])`, "maxLimit"},
+	}
+	for _, singleCase := range cases {
+		s := &mongoRequest{}
+		if err := s.Decode(&http.Request{Method: singleCase.Method, RequestURI: singleCase.Query}); err != nil {
+			t.Fatal(singleCase.Query, err)
+		}
+		err := l.check(s)
+		rule := ""
+		if err != nil {
+			rule = toAPIError(err).Rule
+		}
+		if rule != singleCase.Rule || (err != nil && toAPIError(err).Status != http.StatusBadRequest) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %s\n", singleCase.Method, singleCase.Query)
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestQueryLimitsPageToken(t *testing.T) {
+	l := &queryLimits{AllowOperators: parseOperators("$in"), MaxDepth: 5}
+	s := &mongoRequest{Action: "find", After: &pageToken{Sort: []string{"name", "_id"}, Values: []interface{}{"Ford", 1}}}
+	if err := l.check(s); err != nil {
+		t.Error(err)
+	}
+	s.After.Values[0] = map[string]interface{}{"first": "Ford"}
+	if err := l.check(s); err != nil {
+		t.Error(err)
+	}
+	s.After.Values[0] = map[string]interface{}{"first": map[string]interface{}{"a": 1}}
+	if err := l.check(s); err == nil || toAPIError(err).Rule != "maxDepth" {
+		t.Error(err)
+	}
+}
+
+func TestAllowOperators(t *testing.T) {
+	l := &queryLimits{AllowOperators: parseOperators("$gt,$lt,$set")}
+	s := &mongoRequest{Args1: map[string]interface{}{"a": map[string]interface{}{"$gt": 1}}, Args2: map[string]interface{}{
+		"$set": map[string]interface{}{"b": 1},
+	}}
+	if err := l.check(s); err != nil {
+		t.Error(err)
+	}
+	s.Args1 = map[string]interface{}{"a": map[string]interface{}{"$ne": 1}}
+	if err := l.check(s); err == nil || toAPIError(err).Rule != "allowOperators" {
+		t.Error(err)
+	}
+}
+
+func TestCapDocuments(t *testing.T) {
+	l := &queryLimits{MaxDocuments: 50}
+	s := &mongoRequest{Action: "find"}
+	l.check(s)
+	if sub, ok := s.subAction("limit"); !ok || sub.Args != "50" {
+		t.Error(s.SubActions)
+	}
+	s = &mongoRequest{Action: "find", SubActions: []cursorModifier{{Action: "limit", Args: "0"}}}
+	l.check(s)
+	if sub, ok := s.subAction("limit"); !ok || sub.Args != "50" || len(s.SubActions) != 1 {
+		t.Error(s.SubActions)
+	}
+	s = &mongoRequest{Action: "find", SubActions: []cursorModifier{{Action: "limit", Args: "20"}}}
+	l.check(s)
+	if sub, ok := s.subAction("limit"); !ok || sub.Args != "20" {
+		t.Error(s.SubActions)
+	}
+	s = &mongoRequest{Action: "find", SubActions: []cursorModifier{{Action: "count"}}}
+	l.check(s)
+	if _, ok := s.subAction("limit"); ok {
+		t.Error(s.SubActions)
+	}
+	group := map[string]interface{}{"$group": map[string]interface{}{"_id": "$a"}}
+	s = &mongoRequest{Action: "aggregate", Pipeline: []interface{}{group}}
+	l.check(s)
+	if !reflect.DeepEqual(s.Pipeline, []interface{}{group, map[string]interface{}{"$limit": 50}}) {
+		t.Error(s.Pipeline)
+	}
+	out := map[string]interface{}{"$out": "copy"}
+	s = &mongoRequest{Action: "aggregate", Pipeline: []interface{}{group, out}}
+	l.check(s)
+	if len(s.Pipeline) != 2 {
+		t.Error(s.Pipeline)
+	}
+}
@@ -5,11 +5,16 @@ Copyright (c) 2014 Andrea Masi
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"gopkg.in/mgo.v2"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -20,6 +25,7 @@ func main() {
 	}()
 	var tlsCertFlag = flag.String("ssl-cert", "", "Path to certificate file")
 	var tlsKeyFlag = flag.String("ssl-key", "", "Path to key file")
+	var tlsClientCAFlag = flag.String("ssl-client-ca", "", "Path to CA certificates verifying client certificates, used to authenticate clients.")
 	var portFlag = flag.Int("port", 9002, "Port to listen for requests.")
 	var mongoAddressFlag = flag.String(
 		"mongodb-address",
@@ -31,22 +37,135 @@ func main() {
 		true,
 		"When false, MongoDB does not acknowledge the receipt of write operations. Faster but may lead to data loss.",
 	)
+	var wFlag = flag.String("w", "1", "Default write concern: number of servers acknowledging writes or a mode like majority.")
+	var jFlag = flag.Bool("j", false, "Default write concern: wait for writes to be journaled.")
+	var fsyncFlag = flag.Bool("fsync", false, "Default write concern: wait for writes to be synced to disk.")
+	var wtimeoutFlag = flag.Int("wtimeout", 0, "Default write concern: milliseconds to wait for w servers, 0 waits forever.")
+	var readPreferenceFlag = flag.String(
+		"read-preference",
+		"strong",
+		"Default consistency mode or read preference: strong, monotonic, eventual, primary, primaryPreferred, secondary, secondaryPreferred or nearest.",
+	)
+	var readPreferenceTagsFlag = flag.String(
+		"read-preference-tags",
+		"",
+		"Default read preference tag sets separated by ';', es. dc:east,use:analytics;dc:west",
+	)
+	var maxCursorsFlag = flag.Int("max-cursors", 100, "Maximum number of server side cursors kept open.")
+	var cursorTTLFlag = flag.Duration("cursor-ttl", 10*time.Minute, "Server side cursors idle for longer are closed.")
+	var apiKeysFlag = flag.String("api-keys", "", "Path to file of name:key lines, keys are passed in X-API-Key header.")
+	var basicAuthFlag = flag.String("basic-auth", "", "Path to file of user:bcrypt-hash lines for HTTP Basic authentication.")
+	var jwtHS256Flag = flag.String("jwt-hs256-key", "", "Path to secret verifying HS256 bearer tokens.")
+	var jwtRS256Flag = flag.String("jwt-rs256-key", "", "Path to PEM public key verifying RS256 bearer tokens.")
+	var jwtAudienceFlag = flag.String("jwt-audience", "", "Audience bearer tokens must be issued for.")
+	var jwtIssuerFlag = flag.String("jwt-issuer", "", "Issuer bearer tokens must be issued by.")
+	var jwtScopeFlag = flag.String("jwt-scope", "", "Scope bearer tokens must grant, others get 403.")
+	var policyFlag = flag.String("policy", "", "Path to JSON policy authorizing actions of authenticated clients.")
+	var denyOperatorsFlag = flag.String("deny-operators", "", "Comma separated operators rejected, es. $where,$function,$accumulator")
+	var allowOperatorsFlag = flag.String("allow-operators", "", "Comma separated operators allowed, others are rejected. Stages are operators too.")
+	var maxDepthFlag = flag.Int("max-depth", 0, "Maximum nesting of documents and arrays in queries and documents, 0 for no limit.")
+	var maxInFlag = flag.Int("max-in", 0, "Maximum number of elements of $in and $nin, 0 for no limit.")
+	var maxLimitFlag = flag.Int("max-limit", 0, "Maximum value of limit() and $limit, 0 for no limit.")
+	var maxDocumentsFlag = flag.Int("max-documents", 0, "Maximum number of documents returned by find and aggregate, 0 for no limit.")
 	flag.Parse()
+	var auths []authenticator
+	if *apiKeysFlag != "" {
+		a, err := newAPIKeyAuth(*apiKeysFlag)
+		if err != nil {
+			log.Fatalf("Unable to load API keys: %s", err)
+		}
+		auths = append(auths, a)
+	}
+	if *basicAuthFlag != "" {
+		a, err := newBasicAuth(*basicAuthFlag)
+		if err != nil {
+			log.Fatalf("Unable to load credentials: %s", err)
+		}
+		auths = append(auths, a)
+	}
+	if *jwtHS256Flag != "" || *jwtRS256Flag != "" {
+		a, err := newJWTAuth(*jwtHS256Flag, *jwtRS256Flag)
+		if err != nil {
+			log.Fatalf("Unable to load JWT keys: %s", err)
+		}
+		a.audience, a.issuer, a.scope = *jwtAudienceFlag, *jwtIssuerFlag, *jwtScopeFlag
+		auths = append(auths, a)
+	}
+	var tlsConfig *tls.Config
+	if *tlsClientCAFlag != "" {
+		pem, err := ioutil.ReadFile(*tlsClientCAFlag)
+		if err != nil {
+			log.Fatalf("Unable to load client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", *tlsClientCAFlag)
+		}
+		tlsConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+		auths = append(auths, &certAuth{})
+	}
+	if *policyFlag != "" {
+		if len(auths) == 0 {
+			log.Fatalf("Policy requires authentication")
+		}
+		p, err := loadPolicy(*policyFlag)
+		if err != nil {
+			log.Fatalf("Unable to load policy: %s", err)
+		}
+		policy = p
+	}
 	msession, err := mgo.Dial(*mongoAddressFlag)
 	if err != nil {
 		// Deferred functions are not run becuse os.Exit(1) is called in the end
 		log.Fatalf("Unable to connect to Mongodb: %s", err)
 	}
+	safe, err := newSafe(*wFlag, *jFlag, *fsyncFlag, *wtimeoutFlag)
+	if err != nil {
+		log.Fatalf("Invalid write concern: %s", err)
+	}
 	if !*safeFlag {
-		// msession.SetSafe(&mgo.Safe{WTimeout:100})
-		msession.SetSafe(nil)
+		safe = nil
+	}
+	msession.SetSafe(safe)
+	var tagSets []string
+	if *readPreferenceTagsFlag != "" {
+		tagSets = strings.Split(*readPreferenceTagsFlag, ";")
+	}
+	readPref, err := newReadPreference(*readPreferenceFlag, tagSets)
+	if err != nil {
+		log.Fatalf("Invalid read preference: %s", err)
 	}
+	readPref.apply(msession)
 	defer msession.Close()
-	http.HandleFunc("/", MakeMainHandler(msession))
-	if *tlsKeyFlag == "" && *tlsCertFlag == "" {
-		http.ListenAndServe(fmt.Sprintf(":%d", *portFlag), nil)
+	limits = &queryLimits{
+		DenyOperators: parseOperators(*denyOperatorsFlag),
+		MaxDepth:      *maxDepthFlag,
+		MaxIn:         *maxInFlag,
+		MaxLimit:      *maxLimitFlag,
+		MaxDocuments:  *maxDocumentsFlag,
+	}
+	if *allowOperatorsFlag != "" {
+		limits.AllowOperators = parseOperators(*allowOperatorsFlag)
+	}
+	cursors = newCursorRegistry(*maxCursorsFlag, *cursorTTLFlag)
+	go cursors.expireLoop(*cursorTTLFlag / 4)
+	mainHandler, cursorsHandler := MakeMainHandler(msession), MakeCursorsHandler()
+	if len(auths) > 0 {
+		mainHandler = RequireAuth(mainHandler, auths)
+		cursorsHandler = RequireAuth(cursorsHandler, auths)
+	} else {
+		log.Println("[WARNING] No authentication configured, any client can access all databases")
+	}
+	http.HandleFunc("/", mainHandler)
+	http.HandleFunc("/_cursors/", cursorsHandler)
+	if policy != nil {
+		http.HandleFunc("/_policy/", RequireAuth(MakePolicyHandler(), auths))
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *portFlag), TLSConfig: tlsConfig}
+	if *tlsKeyFlag == "" && *tlsCertFlag == "" && tlsConfig == nil {
+		server.ListenAndServe()
 	} else if *tlsKeyFlag != "" && *tlsCertFlag != "" {
-		http.ListenAndServeTLS(fmt.Sprintf(":%d", *portFlag), *tlsCertFlag, *tlsKeyFlag, nil)
+		server.ListenAndServeTLS(*tlsCertFlag, *tlsKeyFlag)
 	} else {
 		log.Fatalf("Invalid ssl options")
 	}
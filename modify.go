@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Position of the options document in the arguments of
+// findAndModify and its variants.
+var modifyOptionsArg = map[string]int{
+	"findAndModify":    0,
+	"findOneAndUpdate": 2,
+	"findOneAndDelete": 1,
+}
+
+// Options accepted by findAndModify and its variants.
+var modifyOptions = map[string][]string{
+	"findAndModify":    {"query", "sort", "remove", "update", "new", "fields", "upsert"},
+	"findOneAndUpdate": {"projection", "sort", "upsert", "returnNewDocument"},
+	"findOneAndDelete": {"projection", "sort"},
+}
+
+// modifySpec is the normalized form of findAndModify and its variants.
+type modifySpec struct {
+	Query  map[string]interface{}
+	Fields map[string]interface{}
+	Change mgo.Change
+}
+
+// getModifySpec normalizes arguments of findAndModify,
+// findOneAndUpdate and findOneAndDelete.
+func getModifySpec(s *mongoRequest) (*modifySpec, error) {
+	spec := &modifySpec{}
+	var opts map[string]interface{}
+	switch s.Action {
+	case "findAndModify":
+		opts = s.Args1
+		spec.Query, _ = opts["query"].(map[string]interface{})
+		if _, ok := opts["update"]; ok {
+			update, err := docOption(opts, "update")
+			if err != nil {
+				return nil, err
+			}
+			spec.Change.Update = update
+		}
+	case "findOneAndUpdate":
+		opts = s.Args3
+		spec.Query = s.Args1
+		if s.Args2 == nil {
+			return nil, fmt.Errorf("findOneAndUpdate requires an update document")
+		}
+		spec.Change.Update = s.Args2
+	case "findOneAndDelete":
+		opts = s.Args2
+		spec.Query = s.Args1
+		spec.Change.Remove = true
+	default:
+		return nil, fmt.Errorf("Unable to execute %s", s.Action)
+	}
+	for k := range opts {
+		isSupported := false
+		for _, v := range modifyOptions[s.Action] {
+			if k == v {
+				isSupported = true
+			}
+		}
+		if !isSupported {
+			return nil, fmt.Errorf("Unsupported %s option %s", s.Action, k)
+		}
+	}
+	var err error
+	for _, key := range []string{"query", "sort"} {
+		if _, err = docOption(opts, key); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Fields, err = docOption(opts, "fields"); err != nil {
+		return nil, err
+	}
+	if spec.Fields == nil {
+		if spec.Fields, err = docOption(opts, "projection"); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Fields != nil {
+		if err = checkProjection(spec.Fields); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Change.Upsert, err = boolOption(opts, "upsert"); err != nil {
+		return nil, err
+	}
+	if s.Action == "findAndModify" {
+		if spec.Change.Remove, err = boolOption(opts, "remove"); err != nil {
+			return nil, err
+		}
+		if spec.Change.ReturnNew, err = boolOption(opts, "new"); err != nil {
+			return nil, err
+		}
+		if spec.Change.Remove == (spec.Change.Update != nil) {
+			return nil, fmt.Errorf("findAndModify requires either update or remove")
+		}
+		if spec.Change.Remove && (spec.Change.Upsert || spec.Change.ReturnNew) {
+			return nil, fmt.Errorf("remove cannot be combined with upsert or new")
+		}
+	} else if s.Action == "findOneAndUpdate" {
+		if spec.Change.ReturnNew, err = boolOption(opts, "returnNewDocument"); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// getSortOption decodes, preserving keys order, the sort
+// field of the options document passed as arg.
+func getSortOption(arg callArg) ([]string, error) {
+	value, err := parseOrderedValueString(arg.Raw)
+	if err != nil {
+		return nil, err
+	}
+	opts, ok := value.(bson.D)
+	if !ok {
+		return nil, nil
+	}
+	for _, elem := range opts {
+		if elem.Name != "sort" {
+			continue
+		}
+		spec, ok := elem.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("sort must be a document")
+		}
+		return sortFields(spec)
+	}
+	return nil, nil
+}
+
+// executeModify atomically modifies and returns a single document.
+func executeModify(query *mgo.Query, s *mongoRequest) (interface{}, error) {
+	spec, err := getModifySpec(s)
+	if err != nil {
+		return []byte{}, err
+	}
+	doc := bson.M{}
+	info, err := query.Apply(spec.Change, &doc)
+	if err != nil {
+		return []byte{}, err
+	}
+	// Upserted document is not returned unless new is requested
+	if len(doc) == 0 && info.UpsertedId != nil {
+		return []byte("null"), nil
+	}
+	s.fields.apply(doc)
+	return s.marshal(doc)
+}
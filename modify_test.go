@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+type modifySpecCase struct {
+	Case mongoRequest
+	// Expect an error for this request
+	Invalid bool
+}
+
+func TestGetModifySpec(t *testing.T) {
+	cases := []modifySpecCase{
+		{mongoRequest{Action: "findAndModify", Args1: map[string]interface{}{
+			"query":  map[string]interface{}{"a": float64(1)},
+			"update": map[string]interface{}{"$inc": map[string]interface{}{"n": float64(1)}},
+			"new":    true,
+		}}, false},
+		{mongoRequest{Action: "findAndModify", Args1: map[string]interface{}{"remove": true}}, false},
+		{mongoRequest{Action: "findOneAndDelete", Args2: map[string]interface{}{"sort": map[string]interface{}{"a": float64(1)}}}, false},
+		{mongoRequest{Action: "findOneAndUpdate", Args2: map[string]interface{}{"a": float64(1)}, Args3: map[string]interface{}{"upsert": float64(1)}}, false},
+		{mongoRequest{Action: "findAndModify", Args1: map[string]interface{}{"query": map[string]interface{}{}}}, true},
+		{mongoRequest{Action: "findAndModify", Args1: map[string]interface{}{"remove": true, "update": map[string]interface{}{}}}, true},
+		{mongoRequest{Action: "findAndModify", Args1: map[string]interface{}{"remove": true, "new": true}}, true},
+		{mongoRequest{Action: "findOneAndUpdate", Args1: map[string]interface{}{"a": float64(1)}}, true},
+		{mongoRequest{Action: "findOneAndUpdate", Args2: map[string]interface{}{}, Args3: map[string]interface{}{"new": true}}, true},
+		{mongoRequest{Action: "findOneAndDelete", Args2: map[string]interface{}{"projection": map[string]interface{}{"a": float64(1), "b": float64(0)}}}, true},
+	}
+	for _, singleCase := range cases {
+		spec, err := getModifySpec(&singleCase.Case)
+		if (err != nil) != singleCase.Invalid {
+			if testing.Verbose() {
+				fmt.Printf("case: %+v\n", singleCase)
+				fmt.Printf("got: %+v %v\n", spec, err)
+			}
+			t.Fail()
+		}
+	}
+}
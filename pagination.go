@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Keyset pagination of find: instead of skipping documents, next page
+// starts right after the sort key values of the last document returned.
+// These values travel in an opaque continuation token, so MoREST
+// stays stateless.
+
+// pageToken is the decoded form of a continuation token.
+type pageToken struct {
+	// Sort fields of the paginated query, _id last.
+	Sort []string
+	// Values of sort fields in the last document of the page.
+	Values []interface{}
+}
+
+// encode renders the token as url safe base64 of canonical Extended JSON.
+func (t *pageToken) encode() (string, error) {
+	sort := make([]interface{}, len(t.Sort))
+	for i, field := range t.Sort {
+		sort[i] = field
+	}
+	data, err := marshalExtJSON(bson.D{
+		{Name: "s", Value: sort},
+		{Name: "v", Value: t.Values},
+	}, true)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken decodes a token created by encode.
+func decodePageToken(s string) (*pageToken, error) {
+	invalid := fmt.Errorf("Invalid continuation token")
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, invalid
+	}
+	value, err := parseValueString(string(data))
+	if err != nil {
+		return nil, invalid
+	}
+	doc, _ := value.(map[string]interface{})
+	sort, _ := doc["s"].([]interface{})
+	values, _ := doc["v"].([]interface{})
+	if len(sort) == 0 || len(sort) != len(values) {
+		return nil, invalid
+	}
+	// Values are matched as they are, operators would be injected
+	for _, v := range values {
+		if hasOperators(v) {
+			return nil, invalid
+		}
+	}
+	token := &pageToken{Values: values}
+	for _, field := range sort {
+		name, ok := field.(string)
+		if !ok {
+			return nil, invalid
+		}
+		token.Sort = append(token.Sort, name)
+	}
+	return token, nil
+}
+
+// hasOperators tells if v, or a document embedded in it,
+// has $ prefixed keys.
+func hasOperators(v interface{}) bool {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if isOperatorDoc(value) {
+			return true
+		}
+		for _, e := range value {
+			if hasOperators(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range value {
+			if hasOperators(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pageParams decodes pagination url parameters: paginate asks
+// for a continuation token on the first page, after passes
+// the token to get the next one.
+func pageParams(params url.Values) (bool, *pageToken, error) {
+	if after := params.Get("after"); after != "" {
+		token, err := decodePageToken(after)
+		return true, token, err
+	}
+	paginate := params.Get("paginate")
+	switch paginate {
+	case "", "false":
+		return false, nil, nil
+	case "true":
+		return true, nil, nil
+	}
+	return false, nil, fmt.Errorf("paginate must be true or false")
+}
+
+// pageSort returns sort fields of a paginated find.
+// _id is appended so that documents order is unique.
+func (s *mongoRequest) pageSort() ([]string, error) {
+	fields := []string{}
+	if sub, ok := s.subAction("sort"); ok {
+		var err error
+		fields, err = decodeSortArgs(sub.Args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range fields {
+		name := strings.TrimPrefix(field, "-")
+		if strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("Sort on %s cannot be paginated", name)
+		}
+		if name == "_id" {
+			return fields, nil
+		}
+	}
+	return append(fields, "_id"), nil
+}
+
+// checkPagination validates a paginated find.
+func checkPagination(s *mongoRequest) error {
+	if s.Action != "find" {
+		return fmt.Errorf("Only find can be paginated")
+	}
+	if _, ok := s.subAction("count"); ok {
+		return fmt.Errorf("count cannot be paginated")
+	}
+	limit, ok := s.subAction("limit")
+	if n, err := strconv.Atoi(strings.TrimSpace(limit.Args)); !ok || err != nil || n <= 0 {
+		return fmt.Errorf("Pagination requires a positive limit")
+	}
+	if _, ok := s.subAction("skip"); ok && s.After != nil {
+		return fmt.Errorf("skip cannot be used with a continuation token")
+	}
+	sort, err := s.pageSort()
+	if err != nil {
+		return err
+	}
+	if s.After != nil && strings.Join(sort, ",") != strings.Join(s.After.Sort, ",") {
+		return fmt.Errorf("Continuation token doesn't match sort of the query")
+	}
+	// Sort values are read from returned documents.
+	for _, field := range sort {
+		name := strings.TrimPrefix(field, "-")
+		if !projectionIncludes(s.Args2, name) {
+			return fmt.Errorf("Projection must include sort field %s", name)
+		}
+	}
+	return nil
+}
+
+// projectionIncludes tells if field is returned with projection.
+func projectionIncludes(projection map[string]interface{}, field string) bool {
+	isTrue := func(v interface{}) bool {
+		n, ok := toFloat64(v)
+		return (ok && n != 0) || v == true
+	}
+	for k, v := range projection {
+		if k == field || strings.HasPrefix(field, k+".") {
+			return isTrue(v)
+		}
+	}
+	if field == "_id" {
+		return true
+	}
+	// In an inclusion projection other fields are excluded.
+	for k, v := range projection {
+		if k != "_id" && isTrue(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// pageCriteria returns find criteria selecting documents after the token.
+func pageCriteria(s *mongoRequest) map[string]interface{} {
+	if s.After == nil {
+		return s.Args1
+	}
+	keyset := keysetCriteria(s.After)
+	if len(s.Args1) == 0 {
+		return keyset
+	}
+	return map[string]interface{}{"$and": []interface{}{s.Args1, keyset}}
+}
+
+// keysetCriteria returns criteria selecting documents whose sort
+// key values follow those of the token.
+func keysetCriteria(t *pageToken) map[string]interface{} {
+	or := []interface{}{}
+	for i, field := range t.Sort {
+		clause := map[string]interface{}{}
+		for j := 0; j < i; j++ {
+			clause[strings.TrimPrefix(t.Sort[j], "-")] = map[string]interface{}{"$eq": t.Values[j]}
+		}
+		op := "$gt"
+		if strings.HasPrefix(field, "-") {
+			op = "$lt"
+		}
+		clause[strings.TrimPrefix(field, "-")] = map[string]interface{}{op: t.Values[i]}
+		or = append(or, clause)
+	}
+	return map[string]interface{}{"$or": or}
+}
+
+// lookupField returns the value of a dotted field in doc, nil if missing.
+func lookupField(doc bson.M, field string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(field, ".") {
+		switch v := value.(type) {
+		case bson.M:
+			value = v[name]
+		case map[string]interface{}:
+			value = v[name]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// resultPage is a page of a paginated find.
+type resultPage struct {
+	Docs []bson.M
+	// Continuation token, empty on the last page.
+	NextToken string
+}
+
+// Next implements docIterator.
+func (p *resultPage) Next(result interface{}) bool {
+	if len(p.Docs) == 0 {
+		return false
+	}
+	*result.(*bson.M) = p.Docs[0]
+	p.Docs = p.Docs[1:]
+	return true
+}
+
+// Close implements docIterator.
+func (p *resultPage) Close() error {
+	return nil
+}
+
+// executePage reads a page of documents, one more than limit
+// is requested to know if there is a next page.
+func executePage(query *mgo.Query, s *mongoRequest) (*resultPage, error) {
+	sort, err := s.pageSort()
+	if err != nil {
+		return nil, err
+	}
+	iter := query.Sort(sort...).Limit(s.Limit + 1).Iter()
+	page := &resultPage{}
+	doc := bson.M{}
+	for iter.Next(&doc) {
+		page.Docs = append(page.Docs, doc)
+		doc = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if len(page.Docs) <= s.Limit {
+		return page, nil
+	}
+	page.Docs = page.Docs[:s.Limit]
+	last := page.Docs[len(page.Docs)-1]
+	token := &pageToken{Sort: sort}
+	for _, field := range sort {
+		token.Values = append(token.Values, lookupField(last, strings.TrimPrefix(field, "-")))
+	}
+	page.NextToken, err = token.encode()
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// setNextPageHeaders reports the continuation token of the page,
+// both as X-Next-Token and as a Link to the next page.
+func setNextPageHeaders(w http.ResponseWriter, r *http.Request, s *mongoRequest, page *resultPage) {
+	if page.NextToken == "" {
+		return
+	}
+	path := r.RequestURI
+	if path == "" && r.URL != nil {
+		path = r.URL.EscapedPath()
+	}
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	params := url.Values{}
+	for k, v := range s.Params {
+		params[k] = v
+	}
+	params.Del("paginate")
+	params.Set("after", page.NextToken)
+	w.Header().Set("X-Next-Token", page.NextToken)
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, path, params.Encode()))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPageToken(t *testing.T) {
+	token := &pageToken{
+		Sort: []string{"-when", "n", "_id"},
+		Values: []interface{}{
+			time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+			int64(42),
+			bson.ObjectIdHex("5f1e2d3c4b5a697887766554"),
+		},
+	}
+	s, err := token.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodePageToken(s)
+	if err != nil || !reflect.DeepEqual(got, token) {
+		if testing.Verbose() {
+			fmt.Printf("expected: %#v\n", token)
+			fmt.Printf("got: %#v %v\n", got, err)
+		}
+		t.Fail()
+	}
+	injected := []string{
+		`{"s":["name","_id"],"v":[{"$regex":"^(a+)+$"},1]}`,
+		`{"s":["name","_id"],"v":[{"first":{"$ne":null}},1]}`,
+	}
+	invalids := []string{"xyz", "e30", s[:len(s)-2]}
+	for _, doc := range injected {
+		invalids = append(invalids, base64.RawURLEncoding.EncodeToString([]byte(doc)))
+	}
+	for _, invalid := range invalids {
+		if _, err := decodePageToken(invalid); err == nil {
+			if testing.Verbose() {
+				fmt.Printf("expected error for: %s\n", invalid)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type checkPaginationCase struct {
+	Req *mongoRequest
+	// Expect an error for this request
+	Invalid bool
+}
+
+func TestCheckPagination(t *testing.T) {
+	limit := cursorModifier{"limit", "5"}
+	after := &pageToken{Sort: []string{"-num", "_id"}, Values: []interface{}{1, 2}}
+	cases := []checkPaginationCase{
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{limit}}, false},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"sort", `{"num":-1}`}, limit}, After: after}, false},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"sort", `{"num":1}`}, limit}, After: after}, true},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"sort", `{"num":-1}`}, {"skip", "5"}, limit}, After: after}, true},
+		{&mongoRequest{Action: "find"}, true},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"limit", "0"}}}, true},
+		{&mongoRequest{Action: "findOne", SubActions: []cursorModifier{limit}}, true},
+		{&mongoRequest{Action: "find", SubActions: []cursorModifier{{"sort", `{"$natural":-1}`}, limit}}, true},
+		{&mongoRequest{Action: "find", Args2: map[string]interface{}{"name": 1}, SubActions: []cursorModifier{{"sort", `{"num":1}`}, limit}}, true},
+		{&mongoRequest{Action: "find", Args2: map[string]interface{}{"name": 1, "num": 1}, SubActions: []cursorModifier{{"sort", `{"num":1}`}, limit}}, false},
+		{&mongoRequest{Action: "find", Args2: map[string]interface{}{"_id": 0}, SubActions: []cursorModifier{limit}}, true},
+		{&mongoRequest{Action: "find", Args2: map[string]interface{}{"tags": 0}, SubActions: []cursorModifier{{"sort", `{"num":1}`}, limit}}, false},
+	}
+	for i, singleCase := range cases {
+		err := checkPagination(singleCase.Req)
+		if (err != nil) != singleCase.Invalid {
+			if testing.Verbose() {
+				fmt.Printf("case %d: %+v\n", i+1, singleCase.Req)
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestPageCriteria(t *testing.T) {
+	s := &mongoRequest{
+		Args1: map[string]interface{}{"name": "Ford"},
+		After: &pageToken{Sort: []string{"-num", "_id"}, Values: []interface{}{4, 7}},
+	}
+	expected := map[string]interface{}{"$and": []interface{}{
+		map[string]interface{}{"name": "Ford"},
+		map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"num": map[string]interface{}{"$lt": 4}},
+			map[string]interface{}{"num": map[string]interface{}{"$eq": 4}, "_id": map[string]interface{}{"$gt": 7}},
+		}},
+	}}
+	if got := pageCriteria(s); !reflect.DeepEqual(got, expected) {
+		if testing.Verbose() {
+			fmt.Printf("expected: %#v\n", expected)
+			fmt.Printf("got: %#v\n", got)
+		}
+		t.Fail()
+	}
+	paginate, token, err := pageParams(url.Values{"paginate": {"yes"}})
+	if paginate || token != nil || err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// queryExpr is the parsed form of a shell-style query like:
+// mydb.mycoll.find({"name":"Zaphod"}).sort({"name":-1}).limit(5)
+type queryExpr struct {
+	Database   string
+	Collection string
+	// Calls holds the main action first, followed by its sub actions.
+	Calls []callExpr
+}
+
+// callExpr models a single function call of the chain, es. limit(5).
+type callExpr struct {
+	Name string
+	Args []callArg
+	// Offset of the function name in the parsed string.
+	Pos int
+}
+
+// callArg is a decoded argument of a call.
+// Raw text is kept for those arguments that need a second
+// decoding step (es. sort documents).
+type callArg struct {
+	Value interface{}
+	Raw   string
+	Pos   int
+}
+
+// syntaxError reports a malformed query together with
+// the offset at which the problem was found.
+type syntaxError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// parser is a recursive-descent parser for query strings.
+// Arguments are JSON values, which can contain dots, commas
+// and parentheses inside strings or nested documents.
+type parser struct {
+	src string
+	pos int
+	// When ordered documents are decoded as bson.D
+	// so that keys order is preserved.
+	ordered bool
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &syntaxError{Offset: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+// peek returns next byte without consuming it, 0 on end of input.
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) skipSpaces() {
+	for !p.eof() {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// expect consumes c or fails.
+func (p *parser) expect(c byte) error {
+	p.skipSpaces()
+	if p.peek() != c {
+		if p.eof() {
+			return p.errorf("expected %q, got end of input", c)
+		}
+		return p.errorf("expected %q, got %q", c, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// isNameByte reports if c can be part of a database, collection or function name.
+func isNameByte(c byte) bool {
+	switch c {
+	case '.', '(', ')', ',', '"', '{', '}', '[', ']', ' ', '\t', '\n', '\r', '/', '?':
+		return false
+	}
+	return true
+}
+
+func (p *parser) parseName() string {
+	start := p.pos
+	for !p.eof() && isNameByte(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// parseQuery parses a whole query string. Everything before the first
+// function call is the namespace, first segment being the database.
+// Collection names can contain dots (es. mydb.system.users.find()).
+func parseQuery(s string) (*queryExpr, error) {
+	p := &parser{src: s}
+	expr := &queryExpr{}
+	namespace := []string{}
+	for {
+		start := p.pos
+		name := p.parseName()
+		if name == "" {
+			if p.eof() {
+				return nil, p.errorf("expected a name, got end of input")
+			}
+			return nil, p.errorf("expected a name, got %q", p.peek())
+		}
+		if p.peek() == '(' {
+			p.pos = start
+			break
+		}
+		namespace = append(namespace, name)
+		if p.eof() {
+			return nil, p.errorf("expected an action call, got end of input")
+		}
+		if err := p.expect('.'); err != nil {
+			return nil, err
+		}
+	}
+	if len(namespace) < 2 {
+		return nil, p.errorf("Too few arguments, database and collection are required")
+	}
+	expr.Database = namespace[0]
+	expr.Collection = strings.Join(namespace[1:], ".")
+	for {
+		call, err := p.parseCall()
+		if err != nil {
+			return nil, err
+		}
+		expr.Calls = append(expr.Calls, call)
+		p.skipSpaces()
+		if p.eof() {
+			break
+		}
+		if err := p.expect('.'); err != nil {
+			return nil, err
+		}
+	}
+	return expr, nil
+}
+
+// parseCall parses name(arg1, arg2, ...).
+func (p *parser) parseCall() (callExpr, error) {
+	call := callExpr{Pos: p.pos}
+	call.Name = p.parseName()
+	if call.Name == "" {
+		return call, p.errorf("expected a function name")
+	}
+	if err := p.expect('('); err != nil {
+		return call, err
+	}
+	p.skipSpaces()
+	if p.peek() == ')' {
+		p.pos++
+		return call, nil
+	}
+	for {
+		p.skipSpaces()
+		start := p.pos
+		value, err := p.parseValue()
+		if err != nil {
+			return call, err
+		}
+		call.Args = append(call.Args, callArg{Value: value, Raw: p.src[start:p.pos], Pos: start})
+		p.skipSpaces()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return call, nil
+		case 0:
+			return call, p.errorf("unterminated argument list of %s", call.Name)
+		default:
+			return call, p.errorf("expected ',' or ')', got %q", p.peek())
+		}
+	}
+}
+
+// parseValue parses a JSON value.
+// Mongo shell syntax is accepted too, see shell.go.
+func (p *parser) parseValue() (interface{}, error) {
+	p.skipSpaces()
+	switch c := p.peek(); {
+	case c == '{':
+		return p.parseObject()
+	case c == '[':
+		return p.parseArray()
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '/':
+		return p.parseRegex()
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case c == 0:
+		return nil, p.errorf("expected a value, got end of input")
+	default:
+		return p.parseLiteral()
+	}
+}
+
+// parseObject parses a document, trailing commas are allowed.
+func (p *parser) parseObject() (interface{}, error) {
+	obj := map[string]interface{}{}
+	doc := bson.D{}
+	start := p.pos
+	p.pos++ // {
+	for {
+		p.skipSpaces()
+		if p.peek() == '}' {
+			p.pos++
+			break
+		}
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if p.ordered {
+			doc = append(doc, bson.DocElem{Name: key, Value: value})
+		} else {
+			obj[key] = value
+		}
+		p.skipSpaces()
+		if p.peek() == ',' {
+			p.pos++
+			continue
+		}
+		if p.peek() == '}' {
+			p.pos++
+			break
+		}
+		if p.eof() {
+			return nil, p.errorf("unterminated document")
+		}
+		return nil, p.errorf("expected ',' or '}', got %q", p.peek())
+	}
+	if p.ordered {
+		if len(doc) == 0 {
+			return doc, nil
+		}
+		return orderedExtJSON(doc, start)
+	}
+	value, err := fromExtJSON(obj)
+	if err != nil {
+		return nil, &syntaxError{Offset: start, Msg: err.Error()}
+	}
+	return value, nil
+}
+
+// orderedExtJSON converts Extended JSON type wrappers decoded as bson.D.
+func orderedExtJSON(doc bson.D, offset int) (interface{}, error) {
+	if len(doc) > 2 || !strings.HasPrefix(doc[0].Name, "$") {
+		return doc, nil
+	}
+	value, err := fromExtJSON(doc.Map())
+	if err != nil {
+		return nil, &syntaxError{Offset: offset, Msg: err.Error()}
+	}
+	if _, ok := value.(map[string]interface{}); ok {
+		return doc, nil
+	}
+	return value, nil
+}
+
+// parseArray parses an array, trailing commas are allowed.
+func (p *parser) parseArray() (interface{}, error) {
+	array := []interface{}{}
+	p.pos++ // [
+	for {
+		p.skipSpaces()
+		if p.peek() == ']' {
+			p.pos++
+			return array, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+		p.skipSpaces()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return array, nil
+		case 0:
+			return nil, p.errorf("unterminated array")
+		default:
+			return nil, p.errorf("expected ',' or ']', got %q", p.peek())
+		}
+	}
+}
+
+// parseString parses a quoted string. Double quoted strings
+// are decoded by encoding/json, single quoted ones are converted
+// to double quoted first.
+func (p *parser) parseString() (string, error) {
+	start := p.pos
+	quote := p.src[p.pos]
+	p.pos++
+	for !p.eof() {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case quote:
+			p.pos++
+			literal := p.src[start:p.pos]
+			if quote == '\'' {
+				literal = singleToDoubleQuoted(literal)
+			}
+			var s string
+			if err := json.Unmarshal([]byte(literal), &s); err != nil {
+				return "", &syntaxError{Offset: start, Msg: "invalid string"}
+			}
+			return s, nil
+		}
+		p.pos++
+	}
+	return "", &syntaxError{Offset: start, Msg: "unterminated string"}
+}
+
+// parseNumber parses a JSON number. Dots here are decimal points
+// and not separators.
+// As in relaxed Extended JSON integers are decoded as int (int32 in bson)
+// or int64 if they do not fit, other numbers as float64.
+func (p *parser) parseNumber() (interface{}, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+		if strings.HasPrefix(p.src[p.pos:], "Infinity") {
+			p.pos += len("Infinity")
+			return math.Inf(-1), nil
+		}
+	}
+	digits := func() int {
+		n := 0
+		for !p.eof() && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	if digits() == 0 {
+		return nil, p.errorf("invalid number")
+	}
+	if p.peek() == '.' {
+		p.pos++
+		if digits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	if c := p.peek(); c == 'e' || c == 'E' {
+		p.pos++
+		if c := p.peek(); c == '+' || c == '-' {
+			p.pos++
+		}
+		if digits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	literal := p.src[start:p.pos]
+	if !strings.ContainsAny(literal, ".eE") {
+		if n, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int(n), nil
+			}
+			return n, nil
+		}
+	}
+	f, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, &syntaxError{Offset: start, Msg: "invalid number"}
+	}
+	return f, nil
+}
+
+// parseValueString parses s as a single JSON value.
+func parseValueString(s string) (interface{}, error) {
+	return parseValueStringMode(s, false)
+}
+
+// parseOrderedValueString parses s as a single JSON value
+// decoding documents as bson.D.
+func parseOrderedValueString(s string) (interface{}, error) {
+	return parseValueStringMode(s, true)
+}
+
+func parseValueStringMode(s string, ordered bool) (interface{}, error) {
+	p := &parser{src: s, ordered: ordered}
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q after value", p.peek())
+	}
+	return value, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type parseQueryCase struct {
+	Case     string
+	Expected *queryExpr
+	// Expected offset of syntax error, -1 if none.
+	ErrOffset int
+}
+
+func TestParseQuery(t *testing.T) {
+	cases := []parseQueryCase{
+		{
+			`db.coll.find({"a":{"b":1},"c":2},{"d":1})`,
+			&queryExpr{"db", "coll", []callExpr{{"find", []callArg{
+				{map[string]interface{}{"a": map[string]interface{}{"b": 1}, "c": 2}, `{"a":{"b":1},"c":2}`, 13},
+				{map[string]interface{}{"d": 1}, `{"d":1}`, 33},
+			}, 8}}},
+			-1,
+		},
+		{
+			`db.coll.find({"address.city":"Rome","num":{"$gt":4.5}}).limit(2)`,
+			&queryExpr{"db", "coll", []callExpr{
+				{"find", []callArg{{
+					map[string]interface{}{"address.city": "Rome", "num": map[string]interface{}{"$gt": 4.5}},
+					`{"address.city":"Rome","num":{"$gt":4.5}}`,
+					13,
+				}}, 8},
+				{"limit", []callArg{{2, "2", 62}}, 56},
+			}},
+			-1,
+		},
+		{
+			`db.coll.find({"name":"f(x). \"y\""})`,
+			&queryExpr{"db", "coll", []callExpr{{"find", []callArg{
+				{map[string]interface{}{"name": `f(x). "y"`}, `{"name":"f(x). \"y\""}`, 13},
+			}, 8}}},
+			-1,
+		},
+		{
+			`db.system.users.count()`,
+			&queryExpr{"db", "system.users", []callExpr{{"count", nil, 16}}},
+			-1,
+		},
+		{`db.coll`, nil, 7},
+		{`db.find()`, nil, 3},
+		{`db.coll.find({name:Zaphod})`, nil, 19},
+		{`db.coll.find({"name":"Zaphod"`, nil, 29},
+		{`db.coll.find({"num":4.})`, nil, 22},
+	}
+	for _, singleCase := range cases {
+		got, err := parseQuery(singleCase.Case)
+		if singleCase.ErrOffset >= 0 {
+			sErr, ok := err.(*syntaxError)
+			if !ok || sErr.Offset != singleCase.ErrOffset {
+				if testing.Verbose() {
+					fmt.Printf("expected error at %d for: %s\n", singleCase.ErrOffset, singleCase.Case)
+					fmt.Printf("got: %v\n", err)
+				}
+				t.Fail()
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, singleCase.Expected) {
+			if testing.Verbose() {
+				fmt.Printf("expected: %+v\n", singleCase.Expected)
+				fmt.Printf("got: %+v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type shellSyntaxCase struct {
+	Case     string
+	Expected interface{}
+}
+
+func TestShellSyntax(t *testing.T) {
+	cases := []shellSyntaxCase{
+		{`{name:'Zaphod',"age":42,}`, map[string]interface{}{"name": "Zaphod", "age": 42}},
+		{`{q:'it\'s "ok"'}`, map[string]interface{}{"q": `it's "ok"`}},
+		{`{_id:ObjectId("5f1e2d3c4b5a697887766554")}`, map[string]interface{}{"_id": bson.ObjectIdHex("5f1e2d3c4b5a697887766554")}},
+		{`{d:ISODate("2014-01-01T00:00:00Z")}`, map[string]interface{}{"d": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{`{d:new Date("2014-01-01")}`, map[string]interface{}{"d": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{`{n:NumberLong(42),m:NumberLong("9007199254740993"),i:NumberInt(7)}`, map[string]interface{}{
+			"n": int64(42), "m": int64(9007199254740993), "i": 7,
+		}},
+		{`{name:/^a[/]b/i}`, map[string]interface{}{"name": bson.RegEx{Pattern: "^a[/]b", Options: "i"}}},
+		{`{$or:[{a:1},{b:MinKey},],}`, map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"a": 1}, map[string]interface{}{"b": bson.MinKey},
+		}}},
+		{`{ts:Timestamp(1,2)}`, map[string]interface{}{"ts": bson.MongoTimestamp(1<<32 | 2)}},
+	}
+	for _, singleCase := range cases {
+		got, err := parseValueString(singleCase.Case)
+		if err != nil || !reflect.DeepEqual(got, singleCase.Expected) {
+			if testing.Verbose() {
+				fmt.Printf("expected: %#v\n", singleCase.Expected)
+				fmt.Printf("got: %#v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+	for _, invalid := range []string{`{name:pippo}`, `{a:ObjectId("xyz")}`, `{a:Foo(1)}`, `{a:/abc/q}`, `{,}`, `{a:1,,}`} {
+		if _, err := parseValueString(invalid); err == nil {
+			if testing.Verbose() {
+				fmt.Printf("expected error for: %s\n", invalid)
+			}
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Authorization of authenticated clients. A policy file holds
+// rules granting (or denying) actions on databases and collections
+// to principals, es.:
+//
+//	{"rules": [
+//		{"principals": ["apikey:sensor-*"], "databases": ["telemetry"],
+//		 "collections": ["{{name}}"], "actions": ["insert"]},
+//		{"principals": ["jwt:*"], "claims": {"role": "admin"},
+//		 "databases": ["*"], "collections": ["*"], "actions": ["*"]}
+//	]}
+//
+// Requests not allowed by any rule, or denied by one, get 403.
+
+// policyActions are the actions rules can grant.
+var policyActions = []string{"find", "count", "insert", "update", "remove", "aggregate"}
+
+// policyRule grants or denies actions on matching namespaces.
+// Principals, databases and collections are glob patterns (see path.Match),
+// databases and collections can reference the principal with {{name}}
+// and {{claims.<claim>}} placeholders.
+type policyRule struct {
+	// allow (default) or deny, deny rules take precedence
+	Effect     string   `json:"effect"`
+	Principals []string `json:"principals"`
+	// Claims the principal must have, values are glob patterns
+	Claims      map[string]string `json:"claims"`
+	Databases   []string          `json:"databases"`
+	Collections []string          `json:"collections"`
+	Actions     []string          `json:"actions"`
+	// Documents the rule gives access to, see rowfilter.go
+	Filter json.RawMessage `json:"filter"`
+	filter map[string]interface{}
+	// Fields hidden or protected, see redact.go
+	fieldRules
+}
+
+// accessPolicy is the set of rules loaded from the policy file.
+type accessPolicy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// policy used by handlers, nil when authorization is disabled.
+var policy *accessPolicy
+
+// loadPolicy reads and validates the policy file.
+func loadPolicy(filename string) (*accessPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(data)
+}
+
+// parsePolicy decodes a JSON policy, unknown fields are rejected
+// so that typos don't silently grant or deny access.
+func parsePolicy(data []byte) (*accessPolicy, error) {
+	p := &accessPolicy{}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	}
+	for i := range p.Rules {
+		if err := p.Rules[i].check(); err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+	}
+	return p, nil
+}
+
+// check validates patterns, actions, filter and fields of rule.
+func (rule *policyRule) check() error {
+	if !(rule.Effect == "" || rule.Effect == "allow" || rule.Effect == "deny") {
+		return fmt.Errorf("effect must be allow or deny")
+	}
+	for _, field := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"principals", rule.Principals},
+		{"databases", rule.Databases},
+		{"collections", rule.Collections},
+		{"actions", rule.Actions},
+	} {
+		if len(field.patterns) == 0 {
+			return fmt.Errorf("%s is required", field.name)
+		}
+		for _, pattern := range field.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q in %s", pattern, field.name)
+			}
+		}
+	}
+	for _, pattern := range rule.Claims {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q in claims", pattern)
+		}
+	}
+	for _, action := range rule.Actions {
+		if action != "*" && !containsString(policyActions, action) {
+			return fmt.Errorf("unknown action %s", action)
+		}
+	}
+	if rule.Effect == "deny" && !rule.fieldRules.empty() {
+		return fmt.Errorf("deny rules cannot have field rules")
+	}
+	fields := rule.protected()
+	for _, field := range fields {
+		if field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, "..") {
+			return fmt.Errorf("invalid field %q", field)
+		}
+	}
+	if len(rule.Filter) > 0 {
+		if rule.Effect == "deny" {
+			return fmt.Errorf("deny rules cannot have a filter")
+		}
+		filter, err := parseValueString(string(rule.Filter))
+		if err != nil {
+			return fmt.Errorf("filter: %v", err)
+		}
+		var ok bool
+		if rule.filter, ok = filter.(map[string]interface{}); !ok {
+			return fmt.Errorf("filter must be a document")
+		}
+	}
+	return nil
+}
+
+// matchAny tells if any of patterns matches name.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// claimValues returns the string values of a claim,
+// arrays (es. roles) give one value per element.
+func claimValues(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// expandPattern replaces {{name}} and {{claims.<claim>}} placeholders
+// with values of p, escaped so that they match literally.
+// It returns false if a placeholder cannot be resolved.
+func expandPattern(pattern string, p *principal) (string, bool) {
+	var expanded strings.Builder
+	for {
+		start := strings.Index(pattern, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(pattern[start:], "}}")
+		if end < 0 {
+			break
+		}
+		value, ok := placeholderValue(strings.TrimSpace(pattern[start+2:start+end]), p)
+		if !ok {
+			return "", false
+		}
+		expanded.WriteString(pattern[:start])
+		expanded.WriteString(escapePattern(value))
+		pattern = pattern[start+end+2:]
+	}
+	expanded.WriteString(pattern)
+	return expanded.String(), true
+}
+
+// placeholderValue resolves a placeholder like name or claims.tenant.
+func placeholderValue(name string, p *principal) (string, bool) {
+	if name == "name" {
+		return p.Name, p.Name != ""
+	}
+	if strings.HasPrefix(name, "claims.") {
+		values := claimValues(p.Claims, strings.TrimPrefix(name, "claims."))
+		if len(values) == 1 && values[0] != "" {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+// escapePattern quotes glob meta characters of s.
+func escapePattern(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// matchesPrincipal tells if rule applies to p.
+func (rule *policyRule) matchesPrincipal(p *principal) bool {
+	if !matchAny(rule.Principals, p.id()) {
+		return false
+	}
+	for claim, pattern := range rule.Claims {
+		if !matchAny(claimValues(p.Claims, claim), pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAnyPrincipal is matchAny on patterns expanded for p.
+func matchAnyPrincipal(patterns []string, name string, p *principal) bool {
+	for _, pattern := range patterns {
+		expanded, ok := expandPattern(pattern, p)
+		if ok && matchAny([]string{expanded}, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches tells if rule applies to access by p.
+func (rule *policyRule) matches(p *principal, a access) bool {
+	return rule.matchesPrincipal(p) &&
+		(containsString(rule.Actions, "*") || containsString(rule.Actions, a.Action)) &&
+		matchAnyPrincipal(rule.Databases, a.Database, p) &&
+		matchAnyPrincipal(rule.Collections, a.Collection, p)
+}
+
+// access is an action performed by a request on a namespace.
+type access struct {
+	Action     string
+	Database   string
+	Collection string
+}
+
+// requiredAccesses lists what s needs to be allowed: its action
+// and those implied (es. upsert inserts), plus collections read or
+// written by aggregation stages.
+func requiredAccesses(s *mongoRequest) []access {
+	grant := func(actions ...string) []access {
+		list := []access{}
+		for _, action := range actions {
+			list = append(list, access{action, s.Database, s.Collection})
+		}
+		return list
+	}
+	switch s.Action {
+	case "find":
+		if _, ok := s.subAction("count"); ok {
+			return grant("count")
+		}
+		return grant("find")
+	case "findOne", "distinct":
+		return grant("find")
+	case "count":
+		return grant("count")
+	case "insert":
+		return grant("insert")
+	case "remove":
+		return grant("remove")
+	case "update":
+		if upsert, _ := boolOption(s.Args3, "upsert"); upsert {
+			return grant("update", "insert")
+		}
+		return grant("update")
+	case "findAndModify", "findOneAndUpdate", "findOneAndDelete":
+		spec, err := getModifySpec(s)
+		switch {
+		case err != nil:
+			// Rejected by Check, deny it anyway.
+			return grant("update", "remove")
+		case spec.Change.Remove:
+			return grant("remove")
+		case spec.Change.Upsert:
+			return grant("update", "insert")
+		}
+		return grant("update")
+	case "aggregate":
+		return append(grant("aggregate"), pipelineAccesses(s.Database, s.Collection, s.Pipeline)...)
+	}
+	return grant(s.Action)
+}
+
+// pipelineAccesses lists collections used by $lookup, $graphLookup,
+// $unionWith (read) and $out, $merge (written) stages of pipeline.
+func pipelineAccesses(db, coll string, pipeline []interface{}) []access {
+	list := []access{}
+	for _, v := range pipeline {
+		stage, _ := v.(map[string]interface{})
+		for name, spec := range stage {
+			doc, _ := spec.(map[string]interface{})
+			switch name {
+			case "$lookup", "$graphLookup":
+				if from, ok := doc["from"].(string); ok {
+					list = append(list, access{"find", db, from})
+				}
+				if sub, ok := doc["pipeline"].([]interface{}); ok {
+					list = append(list, pipelineAccesses(db, coll, sub)...)
+				}
+			case "$unionWith":
+				if from, ok := spec.(string); ok {
+					list = append(list, access{"find", db, from})
+				}
+				if from, ok := doc["coll"].(string); ok {
+					list = append(list, access{"find", db, from})
+				}
+				if sub, ok := doc["pipeline"].([]interface{}); ok {
+					list = append(list, pipelineAccesses(db, coll, sub)...)
+				}
+			case "$facet":
+				for _, sub := range doc {
+					if sub, ok := sub.([]interface{}); ok {
+						list = append(list, pipelineAccesses(db, coll, sub)...)
+					}
+				}
+			case "$out":
+				outDB, outColl := outputNamespace(db, spec)
+				list = append(list, access{"insert", outDB, outColl}, access{"remove", outDB, outColl})
+			case "$merge":
+				into := spec
+				if doc != nil {
+					into = doc["into"]
+				}
+				outDB, outColl := outputNamespace(db, into)
+				list = append(list, access{"insert", outDB, outColl}, access{"update", outDB, outColl})
+			}
+		}
+	}
+	return list
+}
+
+// outputNamespace decodes the target of $out and $merge,
+// a collection name or a {db, coll} document.
+func outputNamespace(db string, spec interface{}) (string, string) {
+	switch v := spec.(type) {
+	case string:
+		return db, v
+	case map[string]interface{}:
+		if outDB, ok := v["db"].(string); ok {
+			db = outDB
+		}
+		coll, _ := v["coll"].(string)
+		return db, coll
+	}
+	return db, ""
+}
+
+// allowingRule returns the first rule allowing a to p, nil if none.
+// Its filter and field rules apply to the request.
+func (ap *accessPolicy) allowingRule(p *principal, a access) *policyRule {
+	for i := range ap.Rules {
+		rule := &ap.Rules[i]
+		if rule.Effect != "deny" && rule.matches(p, a) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// policyCheck is the decision taken on a single access.
+type policyCheck struct {
+	Action    string `json:"action"`
+	Namespace string `json:"namespace"`
+	Allowed   bool   `json:"allowed"`
+	// Index of the deciding rule, nil if none matched
+	Rule *int `json:"rule,omitempty"`
+}
+
+// decide evaluates rules for a single access by p.
+func (ap *accessPolicy) decide(p *principal, a access) policyCheck {
+	check := policyCheck{Action: a.Action, Namespace: a.Database + "." + a.Collection}
+	for i := range ap.Rules {
+		rule := &ap.Rules[i]
+		if !rule.matches(p, a) {
+			continue
+		}
+		index := i
+		if rule.Effect == "deny" {
+			check.Allowed, check.Rule = false, &index
+			return check
+		}
+		if check.Rule == nil {
+			check.Allowed, check.Rule = true, &index
+		}
+	}
+	return check
+}
+
+// evaluate decides every access required by s.
+func (ap *accessPolicy) evaluate(p *principal, s *mongoRequest) []policyCheck {
+	checks := []policyCheck{}
+	for _, a := range requiredAccesses(s) {
+		checks = append(checks, ap.decide(p, a))
+	}
+	return checks
+}
+
+// authorize returns a 403 error if s is not allowed to p.
+func (ap *accessPolicy) authorize(p *principal, s *mongoRequest) error {
+	if p == nil {
+		return &apiError{Status: http.StatusForbidden, Code: "Forbidden", Message: "Authentication required by policy"}
+	}
+	for _, check := range ap.evaluate(p, s) {
+		if !check.Allowed {
+			return &apiError{
+				Status:  http.StatusForbidden,
+				Code:    "Forbidden",
+				Message: fmt.Sprintf("%s is not allowed to %s on %s", p.id(), check.Action, check.Namespace),
+			}
+		}
+	}
+	return nil
+}
+
+// MakePolicyHandler serves dry runs of the policy: the query is
+// passed as for the main handler, prefixed by /_policy, and the
+// decision is returned without executing it:
+// {"principal":"apikey:sensor-1","allowed":false,"checks":[...]}
+func MakePolicyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun := r.Clone(r.Context())
+		dryRun.RequestURI = strings.TrimPrefix(r.RequestURI, "/_policy")
+		dryRun.URL.Path = strings.TrimPrefix(r.URL.Path, "/_policy")
+		s := mongoRequest{}
+		if err := s.Decode(dryRun); err != nil {
+			writeError(w, badRequest(err))
+			return
+		}
+		p := principalFrom(r.Context())
+		result := struct {
+			Principal string        `json:"principal"`
+			Allowed   bool          `json:"allowed"`
+			Checks    []policyCheck `json:"checks"`
+			// Row filter applied to the request, see rowfilter.go
+			Filter map[string]interface{} `json:"filter,omitempty"`
+			// Fields hidden or protected, see redact.go
+			Fields *fieldRules `json:"fields,omitempty"`
+		}{Principal: p.id(), Checks: []policyCheck{}}
+		if p != nil {
+			result.Checks = policy.evaluate(p, &s)
+			result.Allowed = policy.authorize(p, &s) == nil
+		}
+		if result.Allowed {
+			filter, err := policy.rowFilter(p, requiredAccesses(&s)[0])
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			result.Filter = filter
+			if rule := policy.allowingRule(p, requiredAccesses(&s)[0]); !rule.fieldRules.empty() {
+				result.Fields = &rule.fieldRules
+			}
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s\n", data)
+	}
+}
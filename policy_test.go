@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{"rules": [
+	{"principals": ["apikey:sensor-*"], "databases": ["telemetry"], "collections": ["{{name}}"], "actions": ["insert"]},
+	{"principals": ["jwt:*"], "claims": {"roles": "analyst"}, "databases": ["tenant-{{claims.tenant}}"], "collections": ["*"], "actions": ["find", "count", "aggregate"]},
+	{"principals": ["jwt:*"], "claims": {"roles": "admin"}, "databases": ["*"], "collections": ["*"], "actions": ["*"]},
+	{"effect": "deny", "principals": ["*"], "databases": ["admin", "local", "config"], "collections": ["*"], "actions": ["*"]}
+]}`
+
+type parsePolicyCase struct {
+	Case string
+	// Expect an error for this policy
+	Invalid bool
+}
+
+func TestParsePolicy(t *testing.T) {
+	rule := func(s string) string {
+		return `{"rules": [` + s + `]}`
+	}
+	cases := []parsePolicyCase{
+		{testPolicy, false},
+		{`{"rules": []}`, false},
+		{rule(`{"principals": ["*"], "databases": ["*"], "collections": ["*"], "actions": ["drop"]}`), true},
+		{rule(`{"principals": ["*"], "databases": ["*"], "collections": ["*"]}`), true},
+		{rule(`{"principals": ["["], "databases": ["*"], "collections": ["*"], "actions": ["*"]}`), true},
+		{rule(`{"effect": "maybe", "principals": ["*"], "databases": ["*"], "collections": ["*"], "actions": ["*"]}`), true},
+		{rule(`{"principal": ["*"], "databases": ["*"], "collections": ["*"], "actions": ["*"]}`), true},
+	}
+	for _, singleCase := range cases {
+		_, err := parsePolicy([]byte(singleCase.Case))
+		if (err != nil) != singleCase.Invalid {
+			if testing.Verbose() {
+				fmt.Printf("case: %s\n", singleCase.Case)
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type authorizeCase struct {
+	Client *principal
+	Method string
+	Query  string
+	// Expected decision
+	Allowed bool
+}
+
+func TestAuthorize(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensor := &principal{Name: "sensor-1", Method: "apikey"}
+	analyst := &principal{Name: "bob", Method: "jwt", Claims: map[string]interface{}{
+		"tenant": "acme", "roles": []interface{}{"analyst"},
+	}}
+	admin := &principal{Name: "root", Method: "jwt", Claims: map[string]interface{}{"roles": "admin"}}
+	cases := []authorizeCase{
+		{sensor, "POST", `/telemetry.sensor-1.insert({"t":1})`, true},
+		{sensor, "POST", `/telemetry.sensor-2.insert({"t":1})`, false},
+		{sensor, "GET", `/telemetry.sensor-1.find()`, false},
+		{sensor, "PUT", `/telemetry.sensor-1.update({},{"t":2})`, false},
+		{analyst, "GET", `/tenant-acme.orders.find().limit(2)`, true},
+		{analyst, "GET", `/tenant-acme.orders.find().count()`, true},
+		{analyst, "GET", `/tenant-other.orders.find()`, false},
+		{analyst, "DELETE", `/tenant-acme.orders.remove({})`, false},
+		{analyst, "GET", `/tenant-acme.orders.aggregate([{"$lookup":{"from":"users","localField":"u","foreignField":"_id","as":"user"}}])`, true},
+		{analyst, "GET", `/tenant-acme.orders.aggregate([{"$out":"copy"}])`, false},
+		{admin, "PUT", `/shop.users.update({},{"a":1},{"upsert":true})`, true},
+		{admin, "DELETE", `/shop.users.findAndModify({"query":{},"remove":true})`, true},
+		{admin, "GET", `/admin.users.find()`, false},
+		{admin, "GET", `/shop.orders.aggregate([{"$merge":{"into":{"db":"local","coll":"x"}}}])`, false},
+		{nil, "GET", `/shop.users.find()`, false},
+	}
+	for _, singleCase := range cases {
+		s := &mongoRequest{}
+		if err := s.Decode(&http.Request{Method: singleCase.Method, RequestURI: singleCase.Query}); err != nil {
+			t.Fatal(singleCase.Query, err)
+		}
+		err := p.authorize(singleCase.Client, s)
+		if (err == nil) != singleCase.Allowed || (err != nil && toAPIError(err).Status != http.StatusForbidden) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %s by %s\n", singleCase.Method, singleCase.Query, singleCase.Client.id())
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestPolicyHandler(t *testing.T) {
+	p, _ := parsePolicy([]byte(testPolicy))
+	defer func(saved *accessPolicy) { policy = saved }(policy)
+	policy = p
+	r := httptest.NewRequest("POST", `/_policy/telemetry.sensor-2.insert({"t":1})`, nil)
+	r = r.WithContext(withPrincipal(r.Context(), &principal{Name: "sensor-1", Method: "apikey"}))
+	w := httptest.NewRecorder()
+	MakePolicyHandler()(w, r)
+	var result struct {
+		Principal string
+		Allowed   bool
+		Checks    []policyCheck
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(w.Body.String())
+	}
+	if w.Code != 200 || result.Principal != "apikey:sensor-1" || result.Allowed ||
+		len(result.Checks) != 1 || result.Checks[0].Namespace != "telemetry.sensor-2" || result.Checks[0].Rule != nil {
+		t.Error(w.Body.String())
+	}
+	r = httptest.NewRequest("GET", `/_policy/telemetry.sensor-1.find(`, nil)
+	w = httptest.NewRecorder()
+	MakePolicyHandler()(w, r)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "SyntaxError") {
+		t.Error(w.Code, w.Body.String())
+	}
+}
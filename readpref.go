@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/url"
+	"strings"
+)
+
+// Consistency modes and read preferences, names are case insensitive.
+var readModes = map[string]mgo.Mode{
+	"strong":             mgo.Strong,
+	"monotonic":          mgo.Monotonic,
+	"eventual":           mgo.Eventual,
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// readPreference selects the servers a session reads from.
+type readPreference struct {
+	Mode mgo.Mode
+	// Tag sets tried in order, empty matches any server
+	Tags []bson.D
+}
+
+// parseReadMode decodes a mode name, es. secondaryPreferred.
+func parseReadMode(name string) (mgo.Mode, error) {
+	mode, ok := readModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Invalid read preference %s", name)
+	}
+	return mode, nil
+}
+
+// parseTagSet decodes a tag set like dc:east,use:analytics.
+// As in mongodb connection strings an empty string matches any server.
+func parseTagSet(s string) (bson.D, error) {
+	tags := bson.D{}
+	if strings.TrimSpace(s) == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid read preference tags %s", s)
+		}
+		tags = append(tags, bson.DocElem{Name: strings.TrimSpace(kv[0]), Value: strings.TrimSpace(kv[1])})
+	}
+	return tags, nil
+}
+
+// newReadPreference builds a read preference from mode and tag sets.
+// Tags cannot be used with primary, which has a single server.
+func newReadPreference(mode string, tagSets []string) (*readPreference, error) {
+	pref := &readPreference{Mode: mgo.Strong}
+	var err error
+	if mode != "" {
+		if pref.Mode, err = parseReadMode(mode); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range tagSets {
+		tags, err := parseTagSet(s)
+		if err != nil {
+			return nil, err
+		}
+		pref.Tags = append(pref.Tags, tags)
+	}
+	if len(pref.Tags) > 0 && pref.Mode == mgo.Primary {
+		return nil, fmt.Errorf("Read preference tags cannot be used with primary")
+	}
+	return pref, nil
+}
+
+// getReadPreference decodes readPreference and readPreferenceTags url
+// parameters, named as in mongodb connection strings:
+// ?readPreference=secondary&readPreferenceTags=dc:east&readPreferenceTags=
+// nil is returned when server default must be used.
+func getReadPreference(params url.Values) (*readPreference, error) {
+	mode := params.Get("readPreference")
+	tagSets := params["readPreferenceTags"]
+	if mode == "" && len(tagSets) == 0 {
+		return nil, nil
+	}
+	if mode == "" {
+		return nil, fmt.Errorf("readPreferenceTags requires readPreference")
+	}
+	return newReadPreference(mode, tagSets)
+}
+
+// apply sets the read preference on session.
+func (p *readPreference) apply(session *mgo.Session) {
+	session.SetMode(p.Mode, true)
+	session.SelectServers(p.Tags...)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type readPreferenceCase struct {
+	Case     string
+	Expected *readPreference
+	// Expect an error for these parameters
+	Invalid bool
+}
+
+func TestGetReadPreference(t *testing.T) {
+	cases := []readPreferenceCase{
+		{"", nil, false},
+		{"readPreference=Monotonic", &readPreference{Mode: mgo.Monotonic}, false},
+		{"readPreference=secondaryPreferred&readPreferenceTags=dc:east,use:analytics&readPreferenceTags=",
+			&readPreference{Mode: mgo.SecondaryPreferred, Tags: []bson.D{
+				{{Name: "dc", Value: "east"}, {Name: "use", Value: "analytics"}},
+				{},
+			}}, false},
+		{"readPreference=nearest&readPreferenceTags=dc:west", &readPreference{Mode: mgo.Nearest, Tags: []bson.D{
+			{{Name: "dc", Value: "west"}},
+		}}, false},
+		{"readPreference=fastest", nil, true},
+		{"readPreferenceTags=dc:east", nil, true},
+		{"readPreference=primary&readPreferenceTags=dc:east", nil, true},
+		{"readPreference=secondary&readPreferenceTags=dc", nil, true},
+	}
+	for _, singleCase := range cases {
+		params, _ := url.ParseQuery(singleCase.Case)
+		got, err := getReadPreference(params)
+		if (err != nil) != singleCase.Invalid || !reflect.DeepEqual(got, singleCase.Expected) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s\n", singleCase.Case)
+				fmt.Printf("got: %+v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// Field level protection. Policy rules can list fields that are
+// removed (redact) or replaced (mask) in documents returned to the
+// client and fields that cannot be written (protect), es.:
+//
+//	{"redact": ["password_hash"], "mask": {"ssn": "***-**-****"}, "protect": ["role"]}
+//
+// Redacted and masked fields are protected too and cannot be used
+// in criteria or sort, otherwise their values could be guessed.
+
+// fieldRules are the field level protections of a policy rule.
+type fieldRules struct {
+	Redact  []string               `json:"redact,omitempty"`
+	Mask    map[string]interface{} `json:"mask,omitempty"`
+	Protect []string               `json:"protect,omitempty"`
+}
+
+// empty tells if f protects no field.
+func (f *fieldRules) empty() bool {
+	return f == nil || len(f.Redact) == 0 && len(f.Mask) == 0 && len(f.Protect) == 0
+}
+
+// hidden returns the fields the client cannot read.
+func (f *fieldRules) hidden() []string {
+	fields := append([]string{}, f.Redact...)
+	for field := range f.Mask {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protected returns the fields the client cannot write.
+func (f *fieldRules) protected() []string {
+	return append(f.hidden(), f.Protect...)
+}
+
+// overlapping returns the first of fields overlapping one of paths.
+func overlapping(fields, paths []string) (string, bool) {
+	for _, field := range fields {
+		for _, p := range paths {
+			if pathsOverlap(field, p) {
+				return field, true
+			}
+		}
+	}
+	return "", false
+}
+
+// apply removes and masks fields of doc, in place.
+// Dotted fields are looked up in embedded documents and arrays.
+func (f *fieldRules) apply(doc interface{}) {
+	if f.empty() {
+		return
+	}
+	for _, field := range f.Redact {
+		editPath(doc, strings.Split(field, "."), func(parent map[string]interface{}, key string) {
+			delete(parent, key)
+		})
+	}
+	for field, value := range f.Mask {
+		value := value
+		editPath(doc, strings.Split(field, "."), func(parent map[string]interface{}, key string) {
+			parent[key] = value
+		})
+	}
+}
+
+// editPath calls edit on the documents holding path, if it exists.
+func editPath(v interface{}, path []string, edit func(parent map[string]interface{}, key string)) {
+	switch value := v.(type) {
+	case bson.M:
+		editPath(map[string]interface{}(value), path, edit)
+	case map[string]interface{}:
+		if _, ok := value[path[0]]; !ok {
+			return
+		}
+		if len(path) == 1 {
+			edit(value, path[0])
+			return
+		}
+		editPath(value[path[0]], path[1:], edit)
+	case []interface{}:
+		for _, e := range value {
+			editPath(e, path, edit)
+		}
+	}
+}
+
+// hasPath tells if path exists in doc.
+func hasPath(v interface{}, path []string) bool {
+	found := false
+	editPath(v, path, func(map[string]interface{}, string) {
+		found = true
+	})
+	return found
+}
+
+// criteriaFields returns the fields used by query criteria, field
+// paths referenced by $expr included. ok is false if criteria use
+// $where, $text, $jsonSchema or expressions reading whole documents,
+// whose fields cannot be known.
+func criteriaFields(criteria map[string]interface{}) (fields []string, ok bool) {
+	ok = true
+	for k, v := range criteria {
+		switch k {
+		case "$and", "$or", "$nor":
+			clauses, _ := v.([]interface{})
+			for _, clause := range clauses {
+				doc, _ := clause.(map[string]interface{})
+				sub, subOk := criteriaFields(doc)
+				fields, ok = append(fields, sub...), ok && subOk
+			}
+		case "$expr":
+			if opaqueExpression(v) {
+				ok = false
+			}
+			fields = append(fields, expressionFields(v)...)
+		case "$where", "$text", "$jsonSchema", "$function", "$accumulator":
+			ok = false
+		default:
+			if !strings.HasPrefix(k, "$") {
+				fields = append(fields, k)
+			}
+		}
+	}
+	return fields, ok
+}
+
+// opaqueExpression tells if an aggregation expression can read
+// fields not named by field paths: $$ROOT and $$CURRENT variables,
+// $getField and JavaScript functions.
+func opaqueExpression(v interface{}) bool {
+	switch value := v.(type) {
+	case string:
+		for _, variable := range []string{"$$ROOT", "$$CURRENT"} {
+			if value == variable || strings.HasPrefix(value, variable+".") {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range value {
+			switch k {
+			case "$getField", "$function", "$accumulator":
+				return true
+			}
+			if opaqueExpression(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range value {
+			if opaqueExpression(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expressionFields returns field paths ("$field") used by an
+// aggregation expression, variables ("$$var") are skipped.
+func expressionFields(v interface{}) []string {
+	fields := []string{}
+	switch value := v.(type) {
+	case string:
+		if strings.HasPrefix(value, "$") && !strings.HasPrefix(value, "$$") {
+			fields = append(fields, value[1:])
+		}
+	case map[string]interface{}:
+		for _, e := range value {
+			fields = append(fields, expressionFields(e)...)
+		}
+	case []interface{}:
+		for _, e := range value {
+			fields = append(fields, expressionFields(e)...)
+		}
+	}
+	return fields
+}
+
+// sortedFields returns the fields s is sorted by.
+func sortedFields(s *mongoRequest) ([]string, error) {
+	keys := s.Sort
+	if sub, ok := s.subAction("sort"); ok {
+		var err error
+		if keys, err = decodeSortArgs(sub.Args); err != nil {
+			return nil, err
+		}
+	}
+	fields := []string{}
+	for _, key := range keys {
+		fields = append(fields, strings.TrimPrefix(strings.TrimPrefix(key, "-"), "$textScore:"))
+	}
+	return fields, nil
+}
+
+// projection returns the projection of find and findAndModify variants.
+func projection(s *mongoRequest) map[string]interface{} {
+	var opts map[string]interface{}
+	switch s.Action {
+	case "find", "findOne":
+		return s.Args2
+	case "findAndModify":
+		opts = s.Args1
+	case "findOneAndUpdate":
+		opts = s.Args3
+	case "findOneAndDelete":
+		opts = s.Args2
+	}
+	if fields, ok := opts["fields"].(map[string]interface{}); ok {
+		return fields
+	}
+	fields, _ := opts["projection"].(map[string]interface{})
+	return fields
+}
+
+// projectionFields returns the fields used by $elemMatch conditions
+// of projection: returned elements tell if they match.
+func projectionFields(projection map[string]interface{}) ([]string, bool) {
+	conditions := map[string]interface{}{}
+	for k, v := range projection {
+		if spec, _ := v.(map[string]interface{}); spec["$elemMatch"] != nil {
+			conditions[k] = spec
+		}
+	}
+	return criteriaFields(conditions)
+}
+
+// checkReadFields rejects requests whose criteria, projection,
+// sort or distinct key use hidden fields.
+func checkReadFields(s *mongoRequest, hidden []string) error {
+	criteria := s.Args1
+	switch s.Action {
+	case "findAndModify":
+		criteria, _ = s.Args1["query"].(map[string]interface{})
+	case "insert", "aggregate":
+		criteria = nil
+	}
+	used, ok := criteriaFields(criteria)
+	projected, projectionOk := projectionFields(projection(s))
+	used = append(used, projected...)
+	if !ok || !projectionOk {
+		return forbidden("Criteria with $where, $text, $jsonSchema or expressions reading whole documents cannot be used on collections with hidden fields")
+	}
+	sorted, err := sortedFields(s)
+	if err != nil {
+		return badRequest(err)
+	}
+	used = append(used, sorted...)
+	if s.Action == "distinct" {
+		used = append(used, s.Key)
+	}
+	if field, ok := overlapping(hidden, used); ok {
+		return forbidden(fmt.Sprintf("Field %s cannot be used in queries", field))
+	}
+	return nil
+}
+
+// checkWriteFields rejects inserts and updates touching protected fields.
+// Replacement documents are rejected as well since they would remove them.
+func checkWriteFields(s *mongoRequest, protected []string) error {
+	var update map[string]interface{}
+	switch s.Action {
+	case "insert":
+		docs := s.JsonPayloadSlice
+		if docs == nil {
+			docs = []interface{}{s.Args1}
+		}
+		for i, doc := range docs {
+			for _, field := range protected {
+				if hasPath(doc, strings.Split(field, ".")) {
+					return forbidden(fmt.Sprintf("Document %d: field %s is protected", i, field))
+				}
+			}
+		}
+		return nil
+	case "update", "findOneAndUpdate", "findAndModify":
+		update = s.Args2
+		criteria := s.Args1
+		upsert, _ := boolOption(s.Args3, "upsert")
+		if s.Action == "findAndModify" {
+			update, _ = s.Args1["update"].(map[string]interface{})
+			criteria, _ = s.Args1["query"].(map[string]interface{})
+			upsert, _ = boolOption(s.Args1, "upsert")
+		}
+		// Upserts insert equality fields of criteria
+		used, _ := criteriaFields(criteria)
+		if field, ok := overlapping(protected, used); ok && upsert {
+			return forbidden(fmt.Sprintf("Field %s is protected and cannot be used in upsert criteria", field))
+		}
+	}
+	if update == nil {
+		return nil
+	}
+	if !isOperatorUpdate(update) {
+		return forbidden("Replacement documents cannot be used on collections with protected fields, use update operators")
+	}
+	if field, ok := overlapping(protected, updatedFields(update)); ok {
+		return forbidden(fmt.Sprintf("Field %s is protected", field))
+	}
+	return nil
+}
+
+// protectPipeline inserts, at the beginning of pipeline, stages
+// removing and masking hidden fields so that later stages cannot
+// read them. $geoNear, which must be the first stage, is kept first.
+func protectPipeline(pipeline []interface{}, f *fieldRules) []interface{} {
+	stages := []interface{}{}
+	if len(f.Redact) > 0 {
+		exclude := map[string]interface{}{}
+		for _, field := range f.Redact {
+			exclude[field] = 0
+		}
+		stages = append(stages, map[string]interface{}{"$project": exclude})
+	}
+	if len(f.Mask) > 0 {
+		masks := map[string]interface{}{}
+		for field, value := range f.Mask {
+			// Mask fields only where they exist
+			masks[field] = map[string]interface{}{"$cond": []interface{}{
+				map[string]interface{}{"$eq": []interface{}{map[string]interface{}{"$type": "$" + field}, "missing"}},
+				"$$REMOVE",
+				map[string]interface{}{"$literal": value},
+			}}
+		}
+		stages = append(stages, map[string]interface{}{"$addFields": masks})
+	}
+	first := 0
+	if len(pipeline) > 0 {
+		if stage, _ := pipeline[0].(map[string]interface{}); stage["$geoNear"] != nil {
+			first = 1
+		}
+	}
+	protected := append([]interface{}{}, pipeline[:first]...)
+	protected = append(protected, stages...)
+	return append(protected, pipeline[first:]...)
+}
+
+// applyFieldRules checks criteria and documents of s against field
+// rules of the rule allowing it and records them to be applied to
+// returned documents.
+func (ap *accessPolicy) applyFieldRules(p *principal, s *mongoRequest) error {
+	rule := ap.allowingRule(p, requiredAccesses(s)[0])
+	if rule == nil || rule.fieldRules.empty() {
+		return nil
+	}
+	f := &rule.fieldRules
+	if err := checkReadFields(s, f.hidden()); err != nil {
+		return err
+	}
+	if err := checkWriteFields(s, f.protected()); err != nil {
+		return err
+	}
+	if s.Action == "aggregate" {
+		if geoNear := geoNearQuery(s.Pipeline); geoNear != nil {
+			if used, ok := criteriaFields(geoNear); !ok {
+				return forbidden("Criteria with $where, $text, $jsonSchema or expressions reading whole documents cannot be used on collections with hidden fields")
+			} else if field, ok := overlapping(f.hidden(), used); ok {
+				return forbidden(fmt.Sprintf("Field %s cannot be used in queries", field))
+			}
+		}
+		s.Pipeline = protectPipeline(s.Pipeline, f)
+	}
+	s.fields = f
+	return nil
+}
+
+// geoNearQuery returns the query of a leading $geoNear stage.
+func geoNearQuery(pipeline []interface{}) map[string]interface{} {
+	if len(pipeline) == 0 {
+		return nil
+	}
+	stage, _ := pipeline[0].(map[string]interface{})
+	geoNear, _ := stage["$geoNear"].(map[string]interface{})
+	query, _ := geoNear["query"].(map[string]interface{})
+	return query
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const testFieldsPolicy = `{"rules": [
+	{"principals": ["*"], "databases": ["app"], "collections": ["users"], "actions": ["*"],
+	 "redact": ["password_hash", "sessions.token"], "mask": {"ssn": "***"}, "protect": ["role"]},
+	{"principals": ["*"], "databases": ["app"], "collections": ["*"], "actions": ["*"]}
+]}`
+
+func TestFieldRulesApply(t *testing.T) {
+	f := &fieldRules{Redact: []string{"password_hash", "sessions.token"}, Mask: map[string]interface{}{"ssn": "***", "card.number": "****"}}
+	doc := bson.M{
+		"name":          "Zaphod",
+		"password_hash": "$2a$...",
+		"ssn":           "123-45-6789",
+		"sessions":      []interface{}{bson.M{"token": "a", "ip": "1.2.3.4"}, bson.M{"ip": "5.6.7.8"}},
+		"card":          bson.M{"brand": "visa"},
+	}
+	f.apply(doc)
+	expected := bson.M{
+		"name":     "Zaphod",
+		"ssn":      "***",
+		"sessions": []interface{}{bson.M{"ip": "1.2.3.4"}, bson.M{"ip": "5.6.7.8"}},
+		"card":     bson.M{"brand": "visa"},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Error(doc)
+	}
+}
+
+type fieldRulesCase struct {
+	Method string
+	Query  string
+	// Expect a 403 error
+	Forbidden bool
+}
+
+func TestApplyFieldRules(t *testing.T) {
+	p, err := parsePolicy([]byte(testFieldsPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &principal{Name: "web", Method: "apikey"}
+	cases := []fieldRulesCase{
+		{"GET", `/app.users.find({"name":"Zaphod"}).sort({"role":1})`, false},
+		{"GET", `/app.users.find({"password_hash":{"$regex":"^a"}})`, true},
+		{"GET", `/app.users.find({"$or":[{"name":"x"},{"ssn":"1"}]})`, true},
+		{"GET", `/app.users.find({"$expr":{"$eq":["$sessions.token","a"]}})`, true},
+		{"GET", `/app.users.find({"$where":"this.name"})`, true},
+		{"GET", `/app.users.count({"$expr":{"$eq":["$$ROOT.ssn","123-45-6789"]}})`, true},
+		{"GET", `/app.users.count({"$expr":{"$eq":[{"$getField":"ssn"},"123-45-6789"]}})`, true},
+		{"GET", `/app.users.count({"$expr":{"$function":{"body":"f","args":["$$ROOT"],"lang":"js"}}})`, true},
+		{"GET", `/app.users.count({"$jsonSchema":{"properties":{"ssn":{"pattern":"^123"}}}})`, true},
+		{"GET", `/app.users.count({"$expr":{"$eq":["$$CURRENT.name","Ford"]}})`, true},
+		{"GET", `/app.users.count({"$expr":{"$eq":["$name","Ford"]}})`, false},
+		{"GET", `/app.users.find().sort({"ssn":1})`, true},
+		{"GET", `/app.users.find({}, {"sessions":{"$elemMatch":{"token":{"$regex":"^a"}}}})`, true},
+		{"GET", `/app.users.find({}, {"name":1, "sessions":{"$slice":1}})`, false},
+		{"GET", `/app.users.findOne({}, {"sessions":{"$elemMatch":{"token":"a"}}})`, true},
+		{"PUT", `/app.users.findAndModify({"query":{"name":"Ford"},"update":{"$set":{"a":1}},"fields":{"sessions":{"$elemMatch":{"token":"a"}}}})`, true},
+		{"DELETE", `/app.users.findOneAndDelete({"name":"Ford"},{"projection":{"sessions":{"$elemMatch":{"token":"a"}}}})`, true},
+		{"GET", `/app.users.find({"$text":{"$search":"123"}})`, true},
+		{"GET", `/app.users.count({"sessions":{"$size":1}})`, true},
+		{"GET", `/app.users.distinct("ssn")`, true},
+		{"GET", `/app.orders.find({"password_hash":1})`, false},
+		{"POST", `/app.users.insert({"name":"Ford"})`, false},
+		{"POST", `/app.users.insert({"name":"Ford","role":"admin"})`, true},
+		{"POST", `/app.users.insert({"name":"Ford","sessions":[{"token":"x"}]})`, true},
+		{"PUT", `/app.users.update({"name":"Ford"},{"$set":{"email":"f@b"}})`, false},
+		{"PUT", `/app.users.update({"name":"Ford"},{"$set":{"role":"admin"}})`, true},
+		{"PUT", `/app.users.update({"name":"Ford"},{"$unset":{"sessions":1}})`, true},
+		{"PUT", `/app.users.update({"name":"Ford"},{"$rename":{"email":"ssn"}})`, true},
+		{"PUT", `/app.users.update({"name":"Ford"},{"name":"Ford"})`, true},
+		{"PUT", `/app.users.update({"role":"admin"},{"$set":{"a":1}})`, false},
+		{"PUT", `/app.users.update({"role":"admin"},{"$set":{"a":1}},{"upsert":true})`, true},
+		{"PUT", `/app.users.findAndModify({"query":{"name":"Ford"},"update":{"$set":{"role":"admin"}}})`, true},
+		{"GET", `/app.users.aggregate([{"$group":{"_id":"$ssn"}}])`, false},
+	}
+	for _, singleCase := range cases {
+		s := &mongoRequest{}
+		if err := s.Decode(&http.Request{Method: singleCase.Method, RequestURI: singleCase.Query}); err != nil {
+			t.Fatal(singleCase.Query, err)
+		}
+		err := p.applyFieldRules(client, s)
+		if (err != nil) != singleCase.Forbidden || (err != nil && toAPIError(err).Status != http.StatusForbidden) {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %s\n", singleCase.Method, singleCase.Query)
+				fmt.Printf("got: %v\n", err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestProtectPipeline(t *testing.T) {
+	f := &fieldRules{Redact: []string{"password_hash"}}
+	geoNear := map[string]interface{}{"$geoNear": map[string]interface{}{"near": []interface{}{0, 0}}}
+	group := map[string]interface{}{"$group": map[string]interface{}{"_id": "$password_hash"}}
+	project := map[string]interface{}{"$project": map[string]interface{}{"password_hash": 0}}
+	got := protectPipeline([]interface{}{geoNear, group}, f)
+	if !reflect.DeepEqual(got, []interface{}{geoNear, project, group}) {
+		t.Error(got)
+	}
+	got = protectPipeline([]interface{}{group}, f)
+	if !reflect.DeepEqual(got, []interface{}{project, group}) {
+		t.Error(got)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Row level security. Policy rules can have a filter document, es.
+// {"tenant_id": "{{claims.tenant}}"}, restricting the documents
+// the client can see or change:
+//
+// - it is ANDed to criteria of find, count, distinct, update, remove
+// and findAndModify variants;
+// - it is prepended as $match stage to aggregate pipelines;
+// - its fields are stamped on inserted and replacement documents;
+// - updates cannot change its fields.
+
+// rowFilter returns the filter of the rule allowing a to p, expanded
+// for p. nil is returned if the rule has no filter.
+func (ap *accessPolicy) rowFilter(p *principal, a access) (map[string]interface{}, error) {
+	rule := ap.allowingRule(p, a)
+	if rule == nil || rule.filter == nil {
+		return nil, nil
+	}
+	filter, err := expandFilter(rule.filter, p)
+	if err != nil {
+		return nil, forbidden(fmt.Sprintf("Filter of rule allowing %s: %v", a.Action, err))
+	}
+	return filter.(map[string]interface{}), nil
+}
+
+// forbidden is a 403 error with message msg.
+func forbidden(msg string) error {
+	return &apiError{Status: http.StatusForbidden, Code: "Forbidden", Message: msg}
+}
+
+// expandFilter returns a copy of v with {{name}} and {{claims.<claim>}}
+// placeholders replaced. A string made of a single placeholder is replaced
+// by the claim value as is, so that numbers and arrays keep their type.
+func expandFilter(v interface{}, p *principal) (interface{}, error) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			var err error
+			if expanded[k], err = expandFilter(e, p); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case []interface{}:
+		expanded := make([]interface{}, len(value))
+		for i, e := range value {
+			var err error
+			if expanded[i], err = expandFilter(e, p); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case string:
+		return expandString(value, p)
+	}
+	return v, nil
+}
+
+// expandString replaces placeholders of s.
+func expandString(s string, p *principal) (interface{}, error) {
+	name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(s, "{{"), "}}"))
+	if strings.HasPrefix(s, "{{") && strings.HasSuffix(s, "}}") && !strings.Contains(name, "{{") {
+		if value, ok := placeholderRaw(name, p); ok {
+			return value, nil
+		}
+		return nil, fmt.Errorf("%s cannot be resolved", s)
+	}
+	var expanded strings.Builder
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			break
+		}
+		placeholder := s[start : start+end+2]
+		value, ok := placeholderValue(strings.TrimSpace(placeholder[2:len(placeholder)-2]), p)
+		if !ok {
+			return nil, fmt.Errorf("%s cannot be resolved", placeholder)
+		}
+		expanded.WriteString(s[:start])
+		expanded.WriteString(value)
+		s = s[start+end+2:]
+	}
+	expanded.WriteString(s)
+	return expanded.String(), nil
+}
+
+// placeholderRaw resolves a placeholder to the value of the claim.
+func placeholderRaw(name string, p *principal) (interface{}, bool) {
+	if name == "name" {
+		return p.Name, p.Name != ""
+	}
+	if strings.HasPrefix(name, "claims.") {
+		value, ok := p.Claims[strings.TrimPrefix(name, "claims.")]
+		return value, ok && value != nil
+	}
+	return nil, false
+}
+
+// andCriteria returns criteria restricted to documents matching filter.
+func andCriteria(criteria, filter map[string]interface{}) map[string]interface{} {
+	if len(criteria) == 0 {
+		return filter
+	}
+	return map[string]interface{}{"$and": []interface{}{criteria, filter}}
+}
+
+// applyRowFilters restricts s to documents matching the filter of the
+// rule allowing it. Aggregation stages using other collections
+// restricted by a filter or field rules are rejected, since
+// restrictions cannot be enforced there.
+func (ap *accessPolicy) applyRowFilters(p *principal, s *mongoRequest) error {
+	filter, err := ap.rowFilter(p, requiredAccesses(s)[0])
+	if err != nil {
+		return err
+	}
+	// Includes the collection itself, es. when joined by $lookup
+	for _, a := range pipelineAccesses(s.Database, s.Collection, s.Pipeline) {
+		if rule := ap.allowingRule(p, a); rule != nil && (rule.filter != nil || !rule.fieldRules.empty()) {
+			return forbidden(fmt.Sprintf("Restricted collection %s.%s cannot be used by aggregation stages", a.Database, a.Collection))
+		}
+	}
+	if filter == nil {
+		return nil
+	}
+	return applyRowFilter(s, filter)
+}
+
+// applyRowFilter rewrites criteria, pipeline or documents of s.
+func applyRowFilter(s *mongoRequest, filter map[string]interface{}) error {
+	var update map[string]interface{}
+	switch s.Action {
+	case "find", "findOne", "count", "distinct", "remove":
+		s.Args1 = andCriteria(s.Args1, filter)
+	case "update", "findOneAndUpdate":
+		s.Args1 = andCriteria(s.Args1, filter)
+		update = s.Args2
+	case "findOneAndDelete":
+		s.Args1 = andCriteria(s.Args1, filter)
+	case "findAndModify":
+		query, _ := s.Args1["query"].(map[string]interface{})
+		s.Args1["query"] = andCriteria(query, filter)
+		update, _ = s.Args1["update"].(map[string]interface{})
+	case "aggregate":
+		s.Pipeline = prependMatch(s.Pipeline, filter)
+	case "insert":
+		docs := s.JsonPayloadSlice
+		if docs == nil {
+			docs = []interface{}{s.Args1}
+		}
+		for i, doc := range docs {
+			doc, _ := doc.(map[string]interface{})
+			if doc == nil {
+				continue
+			}
+			if err := stampDocument(doc, filter); err != nil {
+				return forbidden(fmt.Sprintf("Document %d: %v", i, err))
+			}
+		}
+	}
+	if update == nil {
+		return nil
+	}
+	if !isOperatorUpdate(update) {
+		if err := stampDocument(update, filter); err != nil {
+			return forbidden(err.Error())
+		}
+		return nil
+	}
+	for _, field := range updatedFields(update) {
+		for _, k := range filterFields(filter) {
+			if pathsOverlap(field, k) {
+				return forbidden(fmt.Sprintf("Update cannot change filtered field %s", k))
+			}
+		}
+	}
+	return nil
+}
+
+// prependMatch adds a $match stage with filter in front of pipeline.
+// $geoNear must be the first stage, filter goes into its query.
+func prependMatch(pipeline []interface{}, filter map[string]interface{}) []interface{} {
+	if len(pipeline) > 0 {
+		stage, _ := pipeline[0].(map[string]interface{})
+		if geoNear, ok := stage["$geoNear"].(map[string]interface{}); ok {
+			query, _ := geoNear["query"].(map[string]interface{})
+			geoNear["query"] = andCriteria(query, filter)
+			return pipeline
+		}
+	}
+	return append([]interface{}{map[string]interface{}{"$match": filter}}, pipeline...)
+}
+
+// stampDocument sets fields of filter in doc, dotted fields in
+// embedded documents. Only equality filters can be stamped and
+// documents having a different value are rejected.
+func stampDocument(doc, filter map[string]interface{}) error {
+	for k, v := range filter {
+		if strings.HasPrefix(k, "$") || isOperatorDoc(v) {
+			return fmt.Errorf("filter on %s cannot be applied to documents", k)
+		}
+		parts := strings.Split(k, ".")
+		parent := doc
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part]
+			if !ok {
+				child = map[string]interface{}{}
+				parent[part] = child
+			}
+			childDoc, ok := child.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be %v", k, v)
+			}
+			parent = childDoc
+		}
+		last := parts[len(parts)-1]
+		if current, ok := parent[last]; ok && !reflect.DeepEqual(current, v) {
+			return fmt.Errorf("%s must be %v", k, v)
+		}
+		parent[last] = v
+	}
+	return nil
+}
+
+// isOperatorDoc tells if v is a document of query operators, es. {$in: [...]}.
+func isOperatorDoc(v interface{}) bool {
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for k := range doc {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// isOperatorUpdate tells if update uses operators ($set, $inc...)
+// rather than replacing the document.
+func isOperatorUpdate(update map[string]interface{}) bool {
+	return isOperatorDoc(update)
+}
+
+// updatedFields returns the fields changed by an operator update,
+// $rename targets included.
+func updatedFields(update map[string]interface{}) []string {
+	fields := []string{}
+	for op, v := range update {
+		spec, _ := v.(map[string]interface{})
+		for field, arg := range spec {
+			fields = append(fields, field)
+			if op == "$rename" {
+				if target, ok := arg.(string); ok {
+					fields = append(fields, target)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// filterFields returns the fields used by filter,
+// looking into $and, $or and $nor.
+func filterFields(filter map[string]interface{}) []string {
+	fields := []string{}
+	for k, v := range filter {
+		if !strings.HasPrefix(k, "$") {
+			fields = append(fields, k)
+			continue
+		}
+		clauses, _ := v.([]interface{})
+		for _, clause := range clauses {
+			if doc, ok := clause.(map[string]interface{}); ok {
+				fields = append(fields, filterFields(doc)...)
+			}
+		}
+	}
+	return fields
+}
+
+// pathsOverlap tells if changing field a changes field b,
+// es. address and address.city. Array indexes and positional
+// elements ($, $[], $[<id>]) may stand for any element.
+func pathsOverlap(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] && !isArrayElement(as[i]) && !isArrayElement(bs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isArrayElement tells if a path element is an index or positional operator.
+func isArrayElement(element string) bool {
+	if strings.HasPrefix(element, "$") {
+		return true
+	}
+	_, err := strconv.Atoi(element)
+	return err == nil
+}
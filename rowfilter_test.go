@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const testFilterPolicy = `{"rules": [
+	{"principals": ["jwt:*"], "databases": ["shop"], "collections": ["orders", "invoices"], "actions": ["*"],
+	 "filter": {"tenant_id": "{{claims.tenant}}"}},
+	{"principals": ["jwt:*"], "databases": ["shop"], "collections": ["users"], "actions": ["*"],
+	 "filter": {"owner.name": "user-{{name}}", "level": {"$lte": "{{claims.level}}"}}},
+	{"principals": ["jwt:*"], "databases": ["shop"], "collections": ["*"], "actions": ["*"]}
+]}`
+
+type rowFilterCase struct {
+	Method string
+	Query  string
+	// Expected request after filtering, nil if forbidden
+	Expected *mongoRequest
+}
+
+func TestApplyRowFilters(t *testing.T) {
+	p, err := parsePolicy([]byte(testFilterPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &principal{Name: "bob", Method: "jwt", Claims: map[string]interface{}{"tenant": "acme", "level": float64(3)}}
+	tenant := map[string]interface{}{"tenant_id": "acme"}
+	cases := []rowFilterCase{
+		{"GET", `/shop.orders.find()`, &mongoRequest{Args1: tenant}},
+		{"GET", `/shop.orders.count({"n":1})`, &mongoRequest{Args1: map[string]interface{}{
+			"$and": []interface{}{map[string]interface{}{"n": 1}, tenant},
+		}}},
+		{"GET", `/shop.users.find()`, &mongoRequest{Args1: map[string]interface{}{
+			"owner.name": "user-bob", "level": map[string]interface{}{"$lte": float64(3)},
+		}}},
+		{"GET", `/shop.products.find()`, &mongoRequest{}},
+		{"POST", `/shop.orders.insert({"n":1})`, &mongoRequest{Args1: map[string]interface{}{"n": 1, "tenant_id": "acme"}}},
+		{"POST", `/shop.orders.insert({"n":1,"tenant_id":"acme"})`, &mongoRequest{Args1: map[string]interface{}{"n": 1, "tenant_id": "acme"}}},
+		{"POST", `/shop.orders.insert({"n":1,"tenant_id":"other"})`, nil},
+		{"POST", `/shop.users.insert({"n":1})`, nil},
+		{"PUT", `/shop.orders.update({},{"n":2})`, &mongoRequest{
+			Args1: tenant, Args2: map[string]interface{}{"n": 2, "tenant_id": "acme"},
+		}},
+		{"PUT", `/shop.orders.update({},{"$set":{"n":2}})`, &mongoRequest{
+			Args1: tenant, Args2: map[string]interface{}{"$set": map[string]interface{}{"n": 2}},
+		}},
+		{"PUT", `/shop.orders.update({},{"$set":{"tenant_id":"other"}})`, nil},
+		{"PUT", `/shop.orders.update({},{"$rename":{"n":"tenant_id"}})`, nil},
+		{"PUT", `/shop.users.update({},{"$unset":{"owner":1}})`, nil},
+		{"PUT", `/shop.users.update({},{"$set":{"owner.age":1}})`, &mongoRequest{
+			Args1: map[string]interface{}{"owner.name": "user-bob", "level": map[string]interface{}{"$lte": float64(3)}},
+			Args2: map[string]interface{}{"$set": map[string]interface{}{"owner.age": 1}},
+		}},
+		{"DELETE", `/shop.orders.findAndModify({"query":{"n":1},"remove":true})`, &mongoRequest{Args1: map[string]interface{}{
+			"query":  map[string]interface{}{"$and": []interface{}{map[string]interface{}{"n": 1}, tenant}},
+			"remove": true,
+		}}},
+		{"GET", `/shop.orders.aggregate([{"$group":{"_id":"$n"}}])`, &mongoRequest{Pipeline: []interface{}{
+			map[string]interface{}{"$match": tenant},
+			map[string]interface{}{"$group": map[string]interface{}{"_id": "$n"}},
+		}}},
+		{"GET", `/shop.products.aggregate([{"$lookup":{"from":"invoices","localField":"n","foreignField":"n","as":"x"}}])`, nil},
+	}
+	for _, singleCase := range cases {
+		s := &mongoRequest{}
+		if err := s.Decode(&http.Request{Method: singleCase.Method, RequestURI: singleCase.Query}); err != nil {
+			t.Fatal(singleCase.Query, err)
+		}
+		err := p.applyRowFilters(client, s)
+		ok := err == nil && singleCase.Expected != nil
+		if ok {
+			e := singleCase.Expected
+			ok = reflect.DeepEqual(s.Args1, e.Args1) && reflect.DeepEqual(s.Args2, e.Args2) &&
+				(e.Pipeline == nil || reflect.DeepEqual(s.Pipeline, e.Pipeline))
+		} else {
+			ok = err != nil && singleCase.Expected == nil && toAPIError(err).Status == http.StatusForbidden
+		}
+		if !ok {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %s\n", singleCase.Method, singleCase.Query)
+				fmt.Printf("got: %v %v %v %v\n", s.Args1, s.Args2, s.Pipeline, err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+type pathsOverlapCase struct {
+	A, B     string
+	Expected bool
+}
+
+func TestPathsOverlap(t *testing.T) {
+	cases := []pathsOverlapCase{
+		{"a", "a", true},
+		{"a", "a.b", true},
+		{"a.b.c", "a.b", true},
+		{"a.c", "a.b", false},
+		{"ab", "a", false},
+		{"items.$.tenant", "items.tenant", true},
+		{"items.0.tenant", "items.tenant", true},
+		{"items.$[].n", "owner", false},
+	}
+	for _, singleCase := range cases {
+		if pathsOverlap(singleCase.A, singleCase.B) != singleCase.Expected {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %s\n", singleCase.A, singleCase.B)
+			}
+			t.Fail()
+		}
+	}
+}
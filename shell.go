@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mongo shell syntax accepted by the parser on top of JSON:
+// unquoted keys, single quoted strings, regex literals and
+// constructors like ObjectId("...") or ISODate("...").
+// So queries can be copied straight from the mongo shell.
+
+func isIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '$'
+}
+
+func isIdentByte(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func (p *parser) parseIdent() string {
+	start := p.pos
+	if !p.eof() && isIdentStart(p.src[p.pos]) {
+		p.pos++
+		for !p.eof() && isIdentByte(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	return p.src[start:p.pos]
+}
+
+// parseKey parses a document key, either quoted or not.
+func (p *parser) parseKey() (string, error) {
+	p.skipSpaces()
+	if c := p.peek(); c == '"' || c == '\'' {
+		return p.parseString()
+	}
+	key := p.parseIdent()
+	if key == "" {
+		if p.eof() {
+			return "", p.errorf("unterminated document")
+		}
+		return "", p.errorf("expected a key, got %q", p.peek())
+	}
+	return key, nil
+}
+
+// singleToDoubleQuoted converts a single quoted string literal
+// into a double quoted one.
+func singleToDoubleQuoted(s string) string {
+	s = s[1 : len(s)-1]
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b = append(b, '\'')
+			} else if i+1 < len(s) {
+				b = append(b, c, s[i+1])
+			}
+			i++
+		case '"':
+			b = append(b, '\\', '"')
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(append(b, '"'))
+}
+
+// parseRegex parses a regex literal like /^abc/i.
+func (p *parser) parseRegex() (interface{}, error) {
+	start := p.pos
+	p.pos++ // /
+	inClass := false
+	for !p.eof() {
+		c := p.src[p.pos]
+		if c == '\\' {
+			p.pos += 2
+			continue
+		}
+		if c == '[' {
+			inClass = true
+		} else if c == ']' {
+			inClass = false
+		} else if c == '/' && !inClass {
+			break
+		}
+		p.pos++
+	}
+	if p.eof() {
+		return nil, &syntaxError{Offset: start, Msg: "unterminated regex"}
+	}
+	pattern := p.src[start+1 : p.pos]
+	p.pos++ // /
+	flagsStart := p.pos
+	for !p.eof() && strings.IndexByte("imxsu", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	if !p.eof() && isIdentByte(p.src[p.pos]) {
+		return nil, p.errorf("invalid regex flag %q", p.src[p.pos])
+	}
+	return bson.RegEx{Pattern: pattern, Options: p.src[flagsStart:p.pos]}, nil
+}
+
+// parseLiteral parses true, false, null, Infinity, NaN and constructors.
+func (p *parser) parseLiteral() (interface{}, error) {
+	start := p.pos
+	word := p.parseIdent()
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "NaN":
+		return math.NaN(), nil
+	case "MinKey":
+		if p.peek() != '(' {
+			return bson.MinKey, nil
+		}
+	case "MaxKey":
+		if p.peek() != '(' {
+			return bson.MaxKey, nil
+		}
+	case "new":
+		p.skipSpaces()
+		word = p.parseIdent()
+		if word == "" || p.peek() != '(' {
+			return nil, &syntaxError{Offset: start, Msg: "expected a constructor after new"}
+		}
+	case "":
+		return nil, p.errorf("unexpected %q", p.peek())
+	}
+	if p.peek() != '(' {
+		return nil, &syntaxError{Offset: start, Msg: fmt.Sprintf("unexpected %q", word)}
+	}
+	return p.parseConstructor(word, start)
+}
+
+// parseConstructor parses shell constructors, es. ObjectId("...").
+func (p *parser) parseConstructor(name string, start int) (interface{}, error) {
+	p.pos++ // (
+	args := []interface{}{}
+	for {
+		p.skipSpaces()
+		if p.peek() == ')' {
+			p.pos++
+			break
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+		p.skipSpaces()
+		if p.peek() == ',' {
+			p.pos++
+		} else if p.peek() != ')' {
+			return nil, p.errorf("expected ',' or ')', got %q", p.peek())
+		}
+	}
+	value, err := shellConstructor(name, args)
+	if err != nil {
+		return nil, &syntaxError{Offset: start, Msg: err.Error()}
+	}
+	return value, nil
+}
+
+func shellConstructor(name string, args []interface{}) (interface{}, error) {
+	var arg interface{}
+	switch len(args) {
+	case 0:
+	case 1:
+		arg = args[0]
+	default:
+		if !(name == "Timestamp" || name == "BinData") {
+			return nil, fmt.Errorf("too many arguments for %s", name)
+		}
+	}
+	switch name {
+	case "ObjectId":
+		if arg == nil {
+			return bson.NewObjectId(), nil
+		}
+		s, ok := arg.(string)
+		if !ok || !bson.IsObjectIdHex(s) {
+			return nil, fmt.Errorf("invalid ObjectId")
+		}
+		return bson.ObjectIdHex(s), nil
+	case "ISODate", "Date":
+		if arg == nil {
+			return time.Now().UTC(), nil
+		}
+		return decodeExtDate(arg)
+	case "NumberInt", "NumberLong":
+		var n int64
+		var err error
+		switch v := arg.(type) {
+		case string:
+			n, err = strconv.ParseInt(v, 10, 64)
+		default:
+			var ok bool
+			if n, ok = toInt64(v); !ok {
+				err = fmt.Errorf("not an integer")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		if name == "NumberInt" {
+			if n < math.MinInt32 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			return int(n), nil
+		}
+		return n, nil
+	case "NumberDecimal":
+		s, ok := arg.(string)
+		if !ok {
+			f, isNumber := toFloat64(arg)
+			if !isNumber {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			s = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		d, err := bson.ParseDecimal128(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		return d, nil
+	case "Timestamp":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("Timestamp requires t and i")
+		}
+		t, ok1 := toInt64(args[0])
+		i, ok2 := toInt64(args[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid Timestamp")
+		}
+		return bson.MongoTimestamp(t<<32 | i), nil
+	case "BinData":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("BinData requires subtype and base64 data")
+		}
+		kind, ok1 := toInt64(args[0])
+		b64, ok2 := args[1].(string)
+		if !ok1 || !ok2 || kind < 0 || kind > 255 {
+			return nil, fmt.Errorf("invalid BinData")
+		}
+		data, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BinData")
+		}
+		return bson.Binary{Kind: byte(kind), Data: data}, nil
+	case "MinKey":
+		return bson.MinKey, nil
+	case "MaxKey":
+		return bson.MaxKey, nil
+	}
+	return nil, fmt.Errorf("unknown constructor %s", name)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+)
+
+// Documents written between two flushes of the response.
+const streamFlushEvery = 100
+
+// docIterator is implemented by cursors whose documents are streamed,
+// es. *mgo.Iter.
+type docIterator interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// Media type of newline delimited JSON, one document per line.
+const ndjsonMediaType = "application/x-ndjson"
+
+// streamDocuments writes documents read from iter as a JSON array,
+// or one per line if NDJSON was requested, without buffering
+// the whole result set in memory.
+// The first document is fetched before writing anything so that
+// errors of the query itself can still be reported with a proper
+// status code. Errors that happen later truncate the response,
+// leaving an invalid JSON document to the client.
+// Iteration stops when the client goes away.
+func streamDocuments(w http.ResponseWriter, r *http.Request, iter docIterator, s *mongoRequest) error {
+	defer iter.Close()
+	doc := bson.M{}
+	hasNext := iter.Next(&doc)
+	if !hasNext {
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	open, sep, end := "[", ",", "]\n"
+	w.Header().Set("Content-Type", "application/json")
+	if s.NDJSON {
+		open, sep, end = "", "\n", "\n"
+		w.Header().Set("Content-Type", ndjsonMediaType)
+	}
+	flusher, _ := w.(http.Flusher)
+	ctx := r.Context()
+	w.Write([]byte(open))
+	n := 0
+	for ; hasNext; n++ {
+		select {
+		case <-ctx.Done():
+			log.Printf("[INFO] client gone, stop streaming: %v\n", ctx.Err())
+			return nil
+		default:
+		}
+		if n > 0 {
+			w.Write([]byte(sep))
+		}
+		s.fields.apply(doc)
+		data, err := s.marshal(doc)
+		if err != nil {
+			log.Printf("[ERROR] streaming aborted: %v\n", err)
+			return nil
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil
+		}
+		if flusher != nil && n%streamFlushEvery == streamFlushEvery-1 {
+			flusher.Flush()
+		}
+		doc = bson.M{}
+		hasNext = iter.Next(&doc)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("[ERROR] streaming aborted: %v\n", err)
+		return nil
+	}
+	if n > 0 || !s.NDJSON {
+		w.Write([]byte(end))
+	}
+	return nil
+}
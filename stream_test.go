@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeIterator returns docs, then fails with err.
+type fakeIterator struct {
+	docs []bson.M
+	err  error
+	// Called before each document is returned
+	onNext func()
+}
+
+func (it *fakeIterator) Next(result interface{}) bool {
+	if len(it.docs) == 0 {
+		return false
+	}
+	if it.onNext != nil {
+		it.onNext()
+	}
+	*result.(*bson.M) = it.docs[0]
+	it.docs = it.docs[1:]
+	return true
+}
+
+func (it *fakeIterator) Close() error {
+	return it.err
+}
+
+type streamCase struct {
+	Iter   *fakeIterator
+	NDJSON bool
+	// Expected status and body
+	Status int
+	Body   string
+}
+
+func TestStreamDocuments(t *testing.T) {
+	docs := func() []bson.M {
+		return []bson.M{{"n": 1}, {"n": 2}}
+	}
+	cases := []streamCase{
+		{&fakeIterator{docs: docs()}, false, http.StatusOK, "[{\"n\":1},{\"n\":2}]\n"},
+		{&fakeIterator{docs: docs()}, true, http.StatusOK, "{\"n\":1}\n{\"n\":2}\n"},
+		{&fakeIterator{}, false, http.StatusOK, "[]\n"},
+		{&fakeIterator{}, true, http.StatusOK, ""},
+		{&fakeIterator{err: io.EOF}, false, http.StatusServiceUnavailable, "{\"code\":\"Unavailable\",\"message\":\"EOF\"}\n"},
+		// Errors after the first document truncate the response
+		{&fakeIterator{docs: docs(), err: io.EOF}, false, http.StatusOK, "[{\"n\":1},{\"n\":2}"},
+	}
+	for i, singleCase := range cases {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/db.coll.find()", nil)
+		if err := streamDocuments(recorder, r, singleCase.Iter, &mongoRequest{NDJSON: singleCase.NDJSON}); err != nil {
+			writeError(recorder, err)
+		}
+		if recorder.Code != singleCase.Status || recorder.Body.String() != singleCase.Body {
+			if testing.Verbose() {
+				fmt.Printf("case %d: expected %d %q\n", i+1, singleCase.Status, singleCase.Body)
+				fmt.Printf("got: %d %q\n", recorder.Code, recorder.Body.String())
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestStreamDocumentsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := 0
+	iter := &fakeIterator{docs: []bson.M{{"n": 1}, {"n": 2}, {"n": 3}}, onNext: func() {
+		// Client goes away after the first document
+		if n++; n == 2 {
+			cancel()
+		}
+	}}
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/db.coll.find()", nil).WithContext(ctx)
+	if err := streamDocuments(recorder, r, iter, &mongoRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Body.String() != "[{\"n\":1}" || len(iter.docs) != 1 {
+		if testing.Verbose() {
+			fmt.Printf("got: %q, %d documents left\n", recorder.Body.String(), len(iter.docs))
+		}
+		t.Fail()
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Write concern of insert, update and remove. Server default is set
+// with command line flags, clients can override it passing a writeConcern
+// option or a X-Write-Concern header (es. X-Write-Concern: w=majority, j=true).
+
+// writeConcern is a write concern requested by client.
+type writeConcern struct {
+	// nil for unacknowledged writes (w:0)
+	Safe *mgo.Safe
+}
+
+// newSafe builds the mgo.Safe for w, which can be a number or a
+// mode like "majority". nil is returned for unacknowledged writes.
+func newSafe(w string, j, fsync bool, wtimeout int) (*mgo.Safe, error) {
+	safe := &mgo.Safe{J: j, FSync: fsync, WTimeout: wtimeout}
+	if wtimeout < 0 {
+		return nil, fmt.Errorf("wtimeout must be non-negative")
+	}
+	if n, err := strconv.Atoi(w); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("w must be non-negative")
+		}
+		if n == 0 {
+			if j || fsync {
+				return nil, fmt.Errorf("w:0 cannot be used with j or fsync")
+			}
+			return nil, nil
+		}
+		safe.W = n
+	} else if w != "" {
+		safe.WMode = w
+	}
+	return safe, nil
+}
+
+// decodeWriteConcern decodes a writeConcern option document.
+func decodeWriteConcern(v interface{}) (*writeConcern, error) {
+	opts, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("writeConcern must be a document")
+	}
+	w := ""
+	for k, v := range opts {
+		switch k {
+		case "w":
+			if n, ok := toInt64(v); ok {
+				w = strconv.FormatInt(n, 10)
+			} else if s, ok := v.(string); ok && s != "" {
+				w = s
+			} else {
+				return nil, fmt.Errorf("w must be a number or a string")
+			}
+		case "wtimeout":
+			if _, ok := toInt64(v); !ok {
+				return nil, fmt.Errorf("wtimeout must be an integer")
+			}
+		case "j", "fsync":
+		default:
+			return nil, fmt.Errorf("Unsupported writeConcern option %s", k)
+		}
+	}
+	j, err := boolOption(opts, "j")
+	if err != nil {
+		return nil, err
+	}
+	fsync, err := boolOption(opts, "fsync")
+	if err != nil {
+		return nil, err
+	}
+	wtimeout, _ := toInt64(opts["wtimeout"])
+	safe, err := newSafe(w, j, fsync, int(wtimeout))
+	if err != nil {
+		return nil, err
+	}
+	return &writeConcern{safe}, nil
+}
+
+// parseWriteConcernHeader decodes X-Write-Concern header,
+// es. w=majority, j=true, wtimeout=500
+func parseWriteConcernHeader(h string) (*writeConcern, error) {
+	opts := map[string]interface{}{}
+	for _, pair := range strings.Split(h, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid X-Write-Concern header")
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if n, err := strconv.Atoi(v); err == nil {
+			opts[k] = n
+		} else if b, err := strconv.ParseBool(v); err == nil {
+			opts[k] = b
+		} else {
+			opts[k] = v
+		}
+	}
+	return decodeWriteConcern(opts)
+}
+
+// writeOptions returns the options document of write actions.
+func writeOptions(s *mongoRequest) map[string]interface{} {
+	switch s.Action {
+	case "insert":
+		return insertOptions(s)
+	case "remove":
+		return s.Args2
+	case "update":
+		return s.Args3
+	}
+	return nil
+}
+
+// getWriteConcern returns the write concern requested for
+// a write action, nil if server default must be used.
+func getWriteConcern(s *mongoRequest, r *http.Request) (*writeConcern, error) {
+	if !(s.Action == "insert" || s.Action == "update" || s.Action == "remove") {
+		return nil, nil
+	}
+	if v, ok := writeOptions(s)["writeConcern"]; ok {
+		return decodeWriteConcern(v)
+	}
+	if h := r.Header.Get("X-Write-Concern"); h != "" {
+		return parseWriteConcernHeader(h)
+	}
+	return nil, nil
+}
+
+// writeConcernDoc renders safe as a mongodb writeConcern document.
+func writeConcernDoc(safe *mgo.Safe) bson.D {
+	if safe == nil {
+		return bson.D{{Name: "w", Value: 0}}
+	}
+	var w interface{} = safe.W
+	if safe.WMode != "" {
+		w = safe.WMode
+	} else if safe.W == 0 {
+		w = 1
+	}
+	doc := bson.D{
+		{Name: "w", Value: w},
+		{Name: "j", Value: safe.J},
+		{Name: "wtimeout", Value: safe.WTimeout},
+	}
+	if safe.FSync {
+		doc = append(doc, bson.DocElem{Name: "fsync", Value: true})
+	}
+	return doc
+}
+
+// writeResult renders the result of a write action
+// together with the write concern applied.
+func (s *mongoRequest) writeResult(result bson.D) ([]byte, error) {
+	var safe *mgo.Safe
+	if s.session != nil {
+		safe = s.session.Safe()
+	}
+	return s.marshal(append(result, bson.DocElem{Name: "writeConcern", Value: writeConcernDoc(safe)}))
+}
+
+// acknowledged tells if writes of s are acknowledged by mongodb.
+func (s *mongoRequest) acknowledged() bool {
+	return s.session != nil && s.session.Safe() != nil
+}
+
+// changeResult returns the counts of a remove or update reported by
+// info. Unacknowledged writes (w:0) report no counts, mgo returns
+// no info for them or assumes they succeeded.
+func changeResult(s *mongoRequest, info *mgo.ChangeInfo) bson.D {
+	if info == nil || !s.acknowledged() {
+		return bson.D{}
+	}
+	if s.Action == "remove" {
+		return bson.D{{Name: "nRemoved", Value: info.Removed}}
+	}
+	if upsert, _ := boolOption(s.Args3, "upsert"); upsert && info.Updated == 0 {
+		return bson.D{{Name: "nUpserted", Value: 1}}
+	}
+	if multi, _ := boolOption(s.Args3, "multi"); multi {
+		return bson.D{{Name: "nModified", Value: info.Updated}}
+	}
+	return bson.D{{Name: "nModified", Value: 1}}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type writeConcernCase struct {
+	Req    *http.Request
+	Action string
+	// Options document of the action
+	Options  map[string]interface{}
+	Expected *writeConcern
+	// Expect an error for this request
+	Invalid bool
+}
+
+func TestGetWriteConcern(t *testing.T) {
+	get := &http.Request{Method: "GET"}
+	header := func(h string) *http.Request {
+		return &http.Request{Method: "POST", Header: http.Header{"X-Write-Concern": {h}}}
+	}
+	cases := []writeConcernCase{
+		{get, "insert", nil, nil, false},
+		{get, "find", map[string]interface{}{"writeConcern": map[string]interface{}{"w": 0}}, nil, false},
+		{get, "insert", map[string]interface{}{"writeConcern": map[string]interface{}{"w": 0}}, &writeConcern{}, false},
+		{get, "update", map[string]interface{}{"writeConcern": map[string]interface{}{"w": "majority", "wtimeout": 500, "j": true}},
+			&writeConcern{&mgo.Safe{WMode: "majority", WTimeout: 500, J: true}}, false},
+		{get, "remove", map[string]interface{}{"justOne": true, "writeConcern": map[string]interface{}{"w": 2, "fsync": true}},
+			&writeConcern{&mgo.Safe{W: 2, FSync: true}}, false},
+		{header("w=majority, j=true, wtimeout=100"), "insert", nil,
+			&writeConcern{&mgo.Safe{WMode: "majority", WTimeout: 100, J: true}}, false},
+		{header("w=1"), "insert", map[string]interface{}{"writeConcern": map[string]interface{}{"w": 3}},
+			&writeConcern{&mgo.Safe{W: 3}}, false},
+		{header("w=0"), "remove", nil, &writeConcern{}, false},
+		{get, "insert", map[string]interface{}{"writeConcern": map[string]interface{}{"w": 0, "j": true}}, nil, true},
+		{get, "insert", map[string]interface{}{"writeConcern": map[string]interface{}{"w": -1}}, nil, true},
+		{get, "insert", map[string]interface{}{"writeConcern": map[string]interface{}{"wtimeout": "1s"}}, nil, true},
+		{get, "insert", map[string]interface{}{"writeConcern": map[string]interface{}{"x": 1}}, nil, true},
+		{get, "insert", map[string]interface{}{"writeConcern": true}, nil, true},
+		{header("w"), "insert", nil, nil, true},
+		{header("j=maybe"), "insert", nil, nil, true},
+	}
+	for i, singleCase := range cases {
+		s := &mongoRequest{Action: singleCase.Action}
+		switch singleCase.Action {
+		case "insert", "remove":
+			s.Args2 = singleCase.Options
+		default:
+			s.Args3 = singleCase.Options
+		}
+		got, err := getWriteConcern(s, singleCase.Req)
+		if (err != nil) != singleCase.Invalid || !reflect.DeepEqual(got, singleCase.Expected) {
+			if testing.Verbose() {
+				fmt.Printf("case %d: %+v\n", i+1, singleCase.Options)
+				fmt.Printf("got: %+v %v\n", got, err)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func TestWriteConcernDoc(t *testing.T) {
+	data, _ := marshalExtJSON(writeConcernDoc(&mgo.Safe{WMode: "majority", J: true, FSync: true}), false)
+	if string(data) != `{"w":"majority","j":true,"wtimeout":0,"fsync":true}` {
+		t.Error(string(data))
+	}
+	data, _ = marshalExtJSON(writeConcernDoc(nil), false)
+	if string(data) != `{"w":0}` {
+		t.Error(string(data))
+	}
+}
+
+type changeResultCase struct {
+	Method string
+	Query  string
+	// Write concern of the session, nil for w:0
+	Safe     *mgo.Safe
+	Info     *mgo.ChangeInfo
+	Expected string
+}
+
+func TestChangeResult(t *testing.T) {
+	w1 := &mgo.Safe{}
+	cases := []changeResultCase{
+		{"DELETE", `/db.coll.remove({"a":1})`, w1, &mgo.ChangeInfo{Removed: 3}, `{"nRemoved":3,"writeConcern":{"w":1,"j":false,"wtimeout":0}}`},
+		{"DELETE", `/db.coll.remove({"a":1})`, nil, nil, `{"writeConcern":{"w":0}}`},
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":true})`, w1, &mgo.ChangeInfo{Removed: 1}, `{"nRemoved":1,"writeConcern":{"w":1,"j":false,"wtimeout":0}}`},
+		{"DELETE", `/db.coll.remove({"a":1},{"justOne":true})`, nil, &mgo.ChangeInfo{Removed: 1}, `{"writeConcern":{"w":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"multi":true})`, w1, &mgo.ChangeInfo{Updated: 2}, `{"nModified":2,"writeConcern":{"w":1,"j":false,"wtimeout":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"multi":true})`, nil, nil, `{"writeConcern":{"w":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"upsert":true})`, w1, &mgo.ChangeInfo{Updated: 1}, `{"nModified":1,"writeConcern":{"w":1,"j":false,"wtimeout":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"upsert":true})`, w1, &mgo.ChangeInfo{UpsertedId: 1}, `{"nUpserted":1,"writeConcern":{"w":1,"j":false,"wtimeout":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}},{"upsert":true})`, nil, nil, `{"writeConcern":{"w":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}})`, w1, &mgo.ChangeInfo{Updated: 1}, `{"nModified":1,"writeConcern":{"w":1,"j":false,"wtimeout":0}}`},
+		{"PUT", `/db.coll.update({"a":1},{"$set":{"b":1}})`, nil, &mgo.ChangeInfo{Updated: 1}, `{"writeConcern":{"w":0}}`},
+	}
+	for _, singleCase := range cases {
+		s := &mongoRequest{}
+		if err := s.Decode(&http.Request{Method: singleCase.Method, RequestURI: singleCase.Query}); err != nil {
+			t.Fatal(singleCase.Query, err)
+		}
+		s.session = &mgo.Session{}
+		if singleCase.Safe != nil {
+			s.session.SetSafe(singleCase.Safe)
+		}
+		data, err := s.writeResult(changeResult(s, singleCase.Info))
+		if err != nil || string(data) != singleCase.Expected {
+			if testing.Verbose() {
+				fmt.Printf("case: %s %+v %+v\n", singleCase.Query, singleCase.Safe, singleCase.Info)
+				fmt.Printf("got: %s %v\n", data, err)
+			}
+			t.Fail()
+		}
+	}
+}